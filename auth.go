@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator when credentials were
+// sent but are wrong.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Principal is an authenticated client. Method names the scheme that
+// authenticated it: "basic", "api-key" or "jwt".
+type Principal struct {
+	Name   string
+	Method string
+}
+
+// Authenticator checks the credentials of a request. It returns nil, nil when
+// the request carries none of its kind, so the next authenticator can try.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying principal.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal set by AuthMiddleware, or nil.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// AuthMiddleware requires one of its authenticators to accept a request and
+// answers 401 with Basic and Bearer challenges otherwise.
+type AuthMiddleware struct {
+	realm          string
+	authenticators atomic.Pointer[[]Authenticator]
+}
+
+// NewAuthMiddleware returns a middleware for realm that tries authenticators
+// in order.
+func NewAuthMiddleware(realm string, authenticators ...Authenticator) *AuthMiddleware {
+	m := &AuthMiddleware{realm: realm}
+	m.Update(authenticators...)
+	return m
+}
+
+// Update replaces the authenticators, for example after a config reload.
+func (m *AuthMiddleware) Update(authenticators ...Authenticator) {
+	m.authenticators.Store(&authenticators)
+}
+
+// Handler wraps next so it only sees authenticated requests, with the
+// principal in the request context.
+func (m *AuthMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, authenticator := range *m.authenticators.Load() {
+			principal, err := authenticator.Authenticate(r)
+			if err != nil {
+				m.challenge(w, r, err)
+				return
+			}
+
+			if principal != nil {
+				next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+				return
+			}
+		}
+
+		m.challenge(w, r, errors.New("authentication required"))
+	})
+}
+
+func (m *AuthMiddleware) challenge(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", m.realm))
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", m.realm))
+	detail := "credentials are required"
+	if errors.Is(err, ErrInvalidCredentials) {
+		detail = "the credentials are not valid"
+	}
+	writeProblem(w, r, newProblem(http.StatusUnauthorized, CodeUnauthorized, detail), nil)
+}
+
+const htpasswdCacheTTL = 5 * time.Minute
+
+type verifiedPassword struct {
+	digest  [sha256.Size]byte
+	expires time.Time
+}
+
+// HtpasswdAuthenticator checks Basic credentials against bcrypt hashes in an
+// htpasswd file. The file is reloaded when it changes.
+type HtpasswdAuthenticator struct {
+	path       string
+	checkEvery time.Duration
+	now        func() time.Time
+	mu         sync.Mutex
+	hashes     map[string][]byte
+	dummy      []byte
+	verified   map[string]verifiedPassword
+	modTime    time.Time
+	lastCheck  time.Time
+}
+
+// LoadHtpasswd reads the htpasswd file at path. Only bcrypt hashes are
+// accepted.
+func LoadHtpasswd(path string) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{
+		path:       path,
+		checkEvery: time.Second,
+		now:        time.Now,
+	}
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	a.lastCheck = a.now()
+
+	return a, nil
+}
+
+func (a *HtpasswdAuthenticator) load() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	hashes, err := parseHtpasswd(a.path)
+	if err != nil {
+		return err
+	}
+
+	// Unknown users are checked against a dummy hash of the file's highest
+	// cost, so they take as long to reject as a wrong password.
+	cost := bcrypt.MinCost
+	for _, hash := range hashes {
+		if c, err := bcrypt.Cost(hash); err == nil {
+			cost = max(cost, c)
+		}
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("not a password"), cost)
+	if err != nil {
+		return err
+	}
+
+	a.hashes = hashes
+	a.dummy = dummy
+	a.verified = make(map[string]verifiedPassword)
+	a.modTime = info.ModTime()
+	return nil
+}
+
+func parseHtpasswd(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported: %w", path, line, err)
+		}
+
+		hashes[user] = []byte(hash)
+	}
+
+	return hashes, scanner.Err()
+}
+
+// lookup returns the hash and cached verification for user, re-reading the
+// file first when it changed on disk. A reload drops every cached password.
+func (a *HtpasswdAuthenticator) lookup(user string) (hash, dummy []byte, cached verifiedPassword, known bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now := a.now(); now.Sub(a.lastCheck) >= a.checkEvery {
+		a.lastCheck = now
+		if info, err := os.Stat(a.path); err == nil && !info.ModTime().Equal(a.modTime) {
+			// A failed load usually means the file is being rewritten; keep the old entries.
+			a.load()
+		}
+	}
+
+	hash, known = a.hashes[user]
+	return hash, a.dummy, a.verified[user], known
+}
+
+// Authenticate checks the Basic credentials of r and strips the Authorization
+// header once they are accepted.
+func (a *HtpasswdAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, dummy, cached, known := a.lookup(user)
+	if !known {
+		bcrypt.CompareHashAndPassword(dummy, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	now := a.now()
+
+	if cached.digest != digest || !now.Before(cached.expires) {
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			return nil, ErrInvalidCredentials
+		}
+
+		a.mu.Lock()
+		if bytes.Equal(a.hashes[user], hash) {
+			a.verified[user] = verifiedPassword{digest: digest, expires: now.Add(htpasswdCacheTTL)}
+		}
+		a.mu.Unlock()
+	}
+
+	r.Header.Del("Authorization")
+	return &Principal{Name: user, Method: "basic"}, nil
+}
+
+const apiKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator accepts a key in the X-API-Key header or an
+// "Authorization: ApiKey" header.
+type APIKeyAuthenticator struct {
+	keys map[[sha256.Size]byte]string
+}
+
+// NewAPIKeyAuthenticator maps each key to the principal name it authenticates.
+func NewAPIKeyAuthenticator(keys map[string]string) *APIKeyAuthenticator {
+	a := &APIKeyAuthenticator{keys: make(map[[sha256.Size]byte]string, len(keys))}
+	for key, principal := range keys {
+		a.keys[sha256.Sum256([]byte(key))] = principal
+	}
+	return a
+}
+
+// Authenticate checks the API key of r and strips its header once it is
+// accepted.
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(apiKeyHeader)
+	header := apiKeyHeader
+	if key == "" {
+		scheme, value, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "ApiKey") {
+			return nil, nil
+		}
+		key, header = value, "Authorization"
+	}
+
+	name, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	r.Header.Del(header)
+	return &Principal{Name: name, Method: "api-key"}, nil
+}
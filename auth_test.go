@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, users map[string]string) string {
+	t.Helper()
+
+	var data []byte
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("failed to hash password: %v", err)
+		}
+		data = append(data, user+":"+string(hash)+"\n"...)
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write htpasswd: %v", err)
+	}
+	return path
+}
+
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s testSigner) jwk() map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA", "kid": s.kid,
+			"n": encode(pub.N.Bytes()),
+			"e": encode(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		point, _ := pub.Bytes()
+		return map[string]string{
+			"kty": "EC", "kid": s.kid, "crv": pub.Curve.Params().Name,
+			"x": encode(point[1 : 1+size]),
+			"y": encode(point[1+size:]),
+		}
+	}
+	return nil
+}
+
+func (s testSigner) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		sig.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJWKS(t *testing.T, signers ...testSigner) string {
+	t.Helper()
+
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+	return path
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	rsaSigner := testSigner{kid: "rsa", alg: "RS256", key: rsaKey}
+	ecSigner := testSigner{kid: "ec", alg: "ES256", key: ecKey}
+	forged := testSigner{kid: "ec", alg: "ES256", key: otherKey}
+
+	jwt, err := LoadJWTAuthenticator(JWTConfig{
+		JWKS:     writeJWKS(t, rsaSigner, ecSigner),
+		Issuer:   "https://issuer.example",
+		Audience: "proxy",
+	})
+	if err != nil {
+		t.Fatalf("failed to load jwks: %v", err)
+	}
+
+	htpasswd, err := LoadHtpasswd(writeHtpasswd(t, map[string]string{"alice": "secret"}))
+	if err != nil {
+		t.Fatalf("failed to load htpasswd: %v", err)
+	}
+
+	apiKeys := NewAPIKeyAuthenticator(map[string]string{"k-123": "ci"})
+
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"sub": "bob",
+			"iss": "https://issuer.example",
+			"aud": []string{"proxy"},
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	testCases := []struct {
+		name      string
+		header    http.Header
+		principal *Principal
+	}{
+		{
+			name:      "basic",
+			header:    http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))}},
+			principal: &Principal{Name: "alice", Method: "basic"},
+		},
+		{
+			name:   "basic with wrong password",
+			header: http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong"))}},
+		},
+		{
+			name:   "basic with unknown user",
+			header: http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("mallory:secret"))}},
+		},
+		{
+			name:      "api key header",
+			header:    http.Header{"X-Api-Key": {"k-123"}},
+			principal: &Principal{Name: "ci", Method: "api-key"},
+		},
+		{
+			name:      "api key authorization scheme",
+			header:    http.Header{"Authorization": {"ApiKey k-123"}},
+			principal: &Principal{Name: "ci", Method: "api-key"},
+		},
+		{
+			name:   "unknown api key",
+			header: http.Header{"X-Api-Key": {"nope"}},
+		},
+		{
+			name:      "jwt rsa",
+			header:    http.Header{"Authorization": {"Bearer " + rsaSigner.sign(t, claims(nil))}},
+			principal: &Principal{Name: "bob", Method: "jwt"},
+		},
+		{
+			name:      "jwt ec",
+			header:    http.Header{"Authorization": {"Bearer " + ecSigner.sign(t, claims(nil))}},
+			principal: &Principal{Name: "bob", Method: "jwt"},
+		},
+		{
+			name:   "jwt expired",
+			header: http.Header{"Authorization": {"Bearer " + rsaSigner.sign(t, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))}},
+		},
+		{
+			name:   "jwt wrong audience",
+			header: http.Header{"Authorization": {"Bearer " + rsaSigner.sign(t, claims(map[string]any{"aud": "other"}))}},
+		},
+		{
+			name:   "jwt wrong issuer",
+			header: http.Header{"Authorization": {"Bearer " + rsaSigner.sign(t, claims(map[string]any{"iss": "https://evil.example"}))}},
+		},
+		{
+			name:   "jwt forged signature",
+			header: http.Header{"Authorization": {"Bearer " + forged.sign(t, claims(nil))}},
+		},
+		{
+			name:   "no credentials",
+			header: http.Header{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *Principal
+			var forwarded http.Header
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = PrincipalFromContext(r.Context())
+				forwarded = r.Header.Clone()
+			})
+
+			handler := NewAuthMiddleware("proxy", htpasswd, apiKeys, jwt).Handler(next)
+
+			r := httptest.NewRequest(http.MethodGet, "/proxy/http://example.com", nil)
+			r.Header = tc.header
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if tc.principal == nil {
+				if w.Code != http.StatusUnauthorized {
+					t.Fatalf("expected status code %d, got %d", http.StatusUnauthorized, w.Code)
+				}
+				if len(w.Header().Values("WWW-Authenticate")) != 2 {
+					t.Errorf("expected basic and bearer challenges, got %v", w.Header().Values("WWW-Authenticate"))
+				}
+				return
+			}
+
+			if got == nil || *got != *tc.principal {
+				t.Fatalf("expected principal %+v, got %+v", tc.principal, got)
+			}
+			if forwarded.Get("Authorization") != "" || forwarded.Get("X-Api-Key") != "" {
+				t.Errorf("expected credentials to be stripped before forwarding, got %v", forwarded)
+			}
+		})
+	}
+}
+
+func TestHtpasswdAuthenticatorCache(t *testing.T) {
+	path := writeHtpasswd(t, map[string]string{"alice": "secret"})
+	htpasswd, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatalf("failed to load htpasswd: %v", err)
+	}
+
+	now := time.Now()
+	htpasswd.now = func() time.Time { return now }
+
+	login := func(user, password string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(user, password)
+		principal, _ := htpasswd.Authenticate(r)
+		return principal != nil
+	}
+
+	if !login("alice", "secret") {
+		t.Fatal("expected the password to be accepted")
+	}
+
+	t.Run("expires cached passwords", func(t *testing.T) {
+		htpasswd.mu.Lock()
+		htpasswd.hashes["alice"], _ = bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+		htpasswd.mu.Unlock()
+
+		if !login("alice", "secret") {
+			t.Fatal("expected the cached password to be accepted before it expires")
+		}
+		now = now.Add(htpasswdCacheTTL)
+		if login("alice", "secret") {
+			t.Error("expected the expired cache entry to be checked against the new hash")
+		}
+	})
+
+	t.Run("drops cached passwords on reload", func(t *testing.T) {
+		if !login("alice", "changed") {
+			t.Fatal("expected the current password to be accepted")
+		}
+
+		data, _ := os.ReadFile(writeHtpasswd(t, map[string]string{"alice": "rotated"}))
+		os.WriteFile(path, data, 0o600)
+		os.Chtimes(path, now, now.Add(time.Minute))
+		now = now.Add(time.Second)
+
+		if login("alice", "changed") {
+			t.Error("expected the old password to be rejected after the file changed")
+		}
+		if !login("alice", "rotated") {
+			t.Error("expected the new password to be accepted after the file changed")
+		}
+	})
+
+	t.Run("unknown users cost a bcrypt comparison", func(t *testing.T) {
+		timed := func(user string) time.Duration {
+			fastest := time.Hour
+			for range 5 {
+				start := time.Now()
+				login(user, "wrong")
+				fastest = min(fastest, time.Since(start))
+			}
+			return fastest
+		}
+
+		if unknown, wrong := timed("mallory"), timed("alice"); unknown < wrong/2 {
+			t.Errorf("expected unknown users to take as long as wrong passwords, got %v and %v", unknown, wrong)
+		}
+	})
+}
+
+func TestLoadHtpasswdRejectsNonBcrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(path, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600)
+
+	if _, err := LoadHtpasswd(path); err == nil {
+		t.Error("expected non-bcrypt hash to be rejected")
+	}
+}
+
+func TestProxySessionBoundToPrincipal(t *testing.T) {
+	var withCookie int
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("session-token"); err == nil {
+				withCookie++
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session-token", Value: "abc123", Path: "/"})
+		}),
+	)
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{})
+	handler := NewAuthMiddleware("proxy", NewAPIKeyAuthenticator(map[string]string{
+		"alice-key": "alice",
+		"bob-key":   "bob",
+	})).Handler(proxy)
+
+	send := func(key string, session *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+		r.Header.Set("X-Api-Key", key)
+		if session != nil {
+			r.AddCookie(session)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("alice-key", nil)
+	session := extractSessionCookie(w)
+	if session == nil {
+		t.Fatal("expected a session cookie")
+	}
+
+	w = send("bob-key", session)
+	if stolen := extractSessionCookie(w); stolen == nil || stolen.Value == session.Value {
+		t.Error("expected a fresh session for a different principal")
+	}
+
+	send("alice-key", session)
+
+	if withCookie != 1 {
+		t.Errorf("expected only alice's own follow-up to carry her cookies, got %d", withCookie)
+	}
+}
+
+func TestJWTAuthenticatorRejectsAlgorithmMismatch(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	signer := testSigner{kid: "rsa", alg: "RS256", key: rsaKey}
+
+	jwt, err := LoadJWTAuthenticator(JWTConfig{JWKS: writeJWKS(t, signer)})
+	if err != nil {
+		t.Fatalf("failed to load jwks: %v", err)
+	}
+
+	token := signer.sign(t, map[string]any{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()})
+	mismatched := testSigner{kid: "rsa", alg: "ES256", key: rsaKey}.sign(t, map[string]any{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if _, err := jwt.Authenticate(r); err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer "+mismatched)
+	if _, err := jwt.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials for mismatched algorithm, got %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const (
+	defaultBatchParallelism  = 8
+	defaultBatchMaxItems     = 100
+	defaultBatchMaxItemBody  = 10 << 20
+	defaultBatchMaxTotalBody = 64 << 20
+)
+
+// BatchPolicy limits the /batch endpoint. Zero values use the defaults.
+type BatchPolicy struct {
+	Parallelism  int   `json:"parallelism,omitempty"`
+	MaxItems     int   `json:"max_items,omitempty"`
+	MaxItemBody  int64 `json:"max_item_body,omitempty"`
+	MaxTotalBody int64 `json:"max_total_body,omitempty"`
+}
+
+func (b BatchPolicy) validate() error {
+	var errs []error
+	if b.Parallelism < 0 || b.MaxItems < 0 {
+		errs = append(errs, errors.New("parallelism and max_items must not be negative"))
+	}
+	if b.MaxItemBody < 0 || b.MaxTotalBody < 0 {
+		errs = append(errs, errors.New("max_item_body and max_total_body must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// BatchRequest is one item of a /batch request. Body is text, or base64 when
+// BodyEncoding is "base64".
+type BatchRequest struct {
+	Method       string      `json:"method,omitempty"`
+	URL          string      `json:"url"`
+	Header       http.Header `json:"headers,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+// BatchResponse is the result of one batch item. A failed item has Error set
+// to the problem /proxy/ would have returned.
+type BatchResponse struct {
+	Index        int         `json:"index"`
+	URL          string      `json:"url"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"headers,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	Error        *Problem    `json:"error,omitempty"`
+}
+
+type problemKey struct{}
+
+func captureProblem(r *http.Request, problem *Problem) {
+	if slot, ok := r.Context().Value(problemKey{}).(**Problem); ok {
+		*slot = problem
+	}
+}
+
+// batchBudget is the response body space left for the items of one batch.
+type batchBudget struct {
+	remaining atomic.Int64
+	limit     int64
+}
+
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	limit  int64
+	budget *batchBudget
+	err    error
+}
+
+func (b *batchRecorder) Header() http.Header {
+	return b.header
+}
+
+func (b *batchRecorder) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *batchRecorder) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if int64(b.body.Len()+len(p)) > b.limit {
+		b.err = &BodyTooLargeError{Direction: "batch item response", Limit: b.limit}
+		return 0, b.err
+	}
+	if b.budget.remaining.Add(-int64(len(p))) < 0 {
+		b.err = &BodyTooLargeError{Direction: "batch response", Limit: b.budget.limit}
+		return 0, b.err
+	}
+	return b.body.Write(p)
+}
+
+func (b *batchRecorder) Flush() {}
+
+// BatchHandler serves POST /batch: a JSON array of BatchRequest fetched in the
+// caller's session, answered as a JSON array or as NDJSON lines.
+func (p *Proxy) BatchHandler() http.Handler {
+	return http.HandlerFunc(p.serveBatch)
+}
+
+func (p *Proxy) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	policy := p.Policy()
+	batch := policy.Batch
+
+	body := r.Body
+	if limit := policy.Limits.MaxRequestBody; limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	var items []BatchRequest
+	if err := json.NewDecoder(body).Decode(&items); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			p.writeError(w, r, &BodyTooLargeError{Direction: "request", Limit: tooLarge.Limit})
+			return
+		}
+		p.writeError(w, r, newProblem(http.StatusBadRequest, CodeInvalidBatch, "the body must be a JSON array of requests"))
+		return
+	}
+
+	maxItems := batch.MaxItems
+	if maxItems == 0 {
+		maxItems = defaultBatchMaxItems
+	}
+	if len(items) == 0 || len(items) > maxItems {
+		p.writeError(w, r, newProblem(http.StatusBadRequest, CodeInvalidBatch, fmt.Sprintf("a batch must contain between 1 and %d requests", maxItems)))
+		return
+	}
+
+	parallelism := batch.Parallelism
+	if parallelism == 0 {
+		parallelism = defaultBatchParallelism
+	}
+
+	if p.refuseNewSession(w, r) {
+		return
+	}
+	session := p.getOrCreateSession(w, r, policy.Session)
+
+	budget := &batchBudget{limit: cmp.Or(batch.MaxTotalBody, defaultBatchMaxTotalBody)}
+	budget.remaining.Store(budget.limit)
+	itemLimit := cmp.Or(batch.MaxItemBody, defaultBatchMaxItemBody)
+
+	results := make(chan BatchResponse, len(items))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Go(func() {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-r.Context().Done():
+				results <- batchFailure(i, item.URL, &BodyReadError{Err: r.Context().Err()})
+				return
+			}
+			results <- p.fetchBatchItem(r, session, i, item, &batchRecorder{header: make(http.Header), limit: itemLimit, budget: budget})
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	if mediaType == "application/x-ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		rc := http.NewResponseController(w)
+		encoder := json.NewEncoder(w)
+		for result := range results {
+			encoder.Encode(result)
+			rc.Flush()
+		}
+		return
+	}
+
+	ordered := make([]BatchResponse, len(items))
+	for result := range results {
+		ordered[result.Index] = result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ordered)
+}
+
+func (p *Proxy) fetchBatchItem(r *http.Request, session string, index int, item BatchRequest, rec *batchRecorder) (result BatchResponse) {
+	body := []byte(item.Body)
+	switch item.BodyEncoding {
+	case "", "text":
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(item.Body)
+		if err != nil {
+			return batchFailure(index, item.URL, newProblem(http.StatusBadRequest, CodeInvalidBatch, "the body is not valid base64"))
+		}
+		body = decoded
+	default:
+		return batchFailure(index, item.URL, newProblem(http.StatusBadRequest, CodeInvalidBatch, fmt.Sprintf("body_encoding must be \"text\" or \"base64\", got %q", item.BodyEncoding)))
+	}
+
+	var problem *Problem
+	ctx := context.WithValue(r.Context(), problemKey{}, &problem)
+
+	req, err := http.NewRequestWithContext(ctx, cmp.Or(strings.ToUpper(item.Method), http.MethodGet), "/proxy/", bytes.NewReader(body))
+	if err != nil {
+		return batchFailure(index, item.URL, newProblem(http.StatusBadRequest, CodeInvalidBatch, "the method is not valid"))
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req.Host = r.Host
+	for key, values := range item.Header {
+		req.Header[http.CanonicalHeaderKey(key)] = values
+	}
+	req.Header.Set(targetHeader, item.URL)
+	req.Header.Del("Cookie")
+	req.AddCookie(&http.Cookie{Name: proxySessionCookie, Value: session})
+
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				p.logger.Error("batch item panicked", "url", item.URL, "panic", err, "stack", string(debug.Stack()))
+				result = batchFailure(index, item.URL, newProblem(http.StatusInternalServerError, CodeInternalError, "the proxy failed while handling this request"))
+				return
+			}
+			if rec.err != nil {
+				result = batchFailure(index, item.URL, rec.err)
+				return
+			}
+			result = batchFailure(index, item.URL, &BodyReadError{Err: io.ErrUnexpectedEOF})
+		}
+	}()
+	p.ServeHTTP(rec, req)
+
+	if rec.err != nil {
+		return batchFailure(index, item.URL, rec.err)
+	}
+	if problem != nil {
+		return batchFailure(index, item.URL, problem)
+	}
+
+	for key := range rec.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			rec.header[strings.TrimPrefix(key, http.TrailerPrefix)] = rec.header[key]
+			delete(rec.header, key)
+		}
+	}
+
+	result = BatchResponse{Index: index, URL: item.URL, Status: rec.status, Header: rec.header}
+	if rec.body.Len() > 0 {
+		if utf8.Valid(rec.body.Bytes()) {
+			result.Body, result.BodyEncoding = rec.body.String(), "text"
+		} else {
+			result.Body, result.BodyEncoding = base64.StdEncoding.EncodeToString(rec.body.Bytes()), "base64"
+		}
+	}
+	return result
+}
+
+func batchFailure(index int, url string, err error) BatchResponse {
+	problem := classifyError(err)
+	return BatchResponse{Index: index, URL: url, Status: problem.Status, Error: problem}
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyBatch(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "token", Value: "t1"})
+		case "/whoami":
+			if c, err := r.Cookie("token"); err == nil {
+				w.Write([]byte(c.Value))
+			}
+		case "/echo":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.Header().Set("X-Custom", r.Header.Get("X-Custom"))
+			w.Write(body)
+		case "/binary":
+			w.Write([]byte{0xff, 0x00, 0xfe})
+		}
+	}))
+	defer service.Close()
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedURL := "http://" + closed.Addr().String()
+	closed.Close()
+
+	proxy := NewProxy(&http.Client{})
+	batch := proxy.BatchHandler()
+
+	send := func(t *testing.T, body string, cookies ...*http.Cookie) (*httptest.ResponseRecorder, []BatchResponse) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		batch.ServeHTTP(w, r)
+
+		var results []BatchResponse
+		json.Unmarshal(w.Body.Bytes(), &results)
+		return w, results
+	}
+
+	w, results := send(t, `[
+		{"url": "`+service.URL+`/login"},
+		{"method": "put", "url": "`+service.URL+`/echo", "headers": {"X-Custom": ["yes"]}, "body": "aGk=", "body_encoding": "base64"},
+		{"url": "`+service.URL+`/binary"},
+		{"url": "`+closedURL+`/"},
+		{"url": "ftp://example.com/"}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	testCases := []struct {
+		name         string
+		status       int
+		body         string
+		bodyEncoding string
+		header       string
+		errorCode    ErrorCode
+	}{
+		{name: "login", status: http.StatusOK},
+		{name: "echo", status: http.StatusOK, body: "hi", bodyEncoding: "text", header: "PUT yes"},
+		{name: "binary", status: http.StatusOK, body: "/wD+", bodyEncoding: "base64"},
+		{name: "connection refused", status: http.StatusBadGateway, errorCode: CodeConnectionRefused},
+		{name: "bad scheme", status: http.StatusBadRequest, errorCode: CodeInvalidTarget},
+	}
+
+	if len(results) != len(testCases) {
+		t.Fatalf("expected %d results, got %d", len(testCases), len(results))
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := results[i]
+			if result.Index != i || result.Status != tc.status {
+				t.Fatalf("expected index %d with status %d, got %+v", i, tc.status, result)
+			}
+			if tc.errorCode != "" {
+				if result.Error == nil || result.Error.Code != tc.errorCode {
+					t.Errorf("expected error %s, got %+v", tc.errorCode, result.Error)
+				}
+				return
+			}
+			if result.Error != nil {
+				t.Errorf("unexpected error %+v", result.Error)
+			}
+			if result.Body != tc.body || result.BodyEncoding != tc.bodyEncoding {
+				t.Errorf("expected body %q (%s), got %q (%s)", tc.body, tc.bodyEncoding, result.Body, result.BodyEncoding)
+			}
+			if tc.header != "" && result.Header.Get("X-Method")+" "+result.Header.Get("X-Custom") != tc.header {
+				t.Errorf("expected headers %q, got %v", tc.header, result.Header)
+			}
+		})
+	}
+
+	t.Run("session jar is shared", func(t *testing.T) {
+		var session *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == proxySessionCookie {
+				session = c
+			}
+		}
+		if session == nil {
+			t.Fatal("expected the batch to create a session")
+		}
+
+		_, results := send(t, `[{"url": "`+service.URL+`/whoami"}]`, session)
+		if len(results) != 1 || results[0].Body != "t1" {
+			t.Errorf("expected the login cookie in the caller's jar, got %+v", results)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+"/whoami", nil)
+		r.AddCookie(session)
+		direct := newMockResponseWriter()
+		proxy.ServeHTTP(direct, r)
+		if direct.buffer.String() != "t1" {
+			t.Errorf("expected batch cookies to be visible to /proxy/, got %q", direct.buffer.String())
+		}
+	})
+
+	t.Run("item cookies cannot pick the session", func(t *testing.T) {
+		other := NewProxy(&http.Client{})
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+"/login", nil)
+		r.AddCookie(&http.Cookie{Name: proxySessionCookie, Value: "victim"})
+		other.ServeHTTP(newMockResponseWriter(), r)
+
+		r = httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`[
+			{"url": "`+service.URL+`/whoami", "headers": {"Cookie": ["`+proxySessionCookie+`=victim"]}}
+		]`))
+		w := httptest.NewRecorder()
+		other.BatchHandler().ServeHTTP(w, r)
+
+		var results []BatchResponse
+		json.Unmarshal(w.Body.Bytes(), &results)
+		if len(results) != 1 || results[0].Body != "" {
+			t.Errorf("expected the item to run in the caller's own session, got %+v", results)
+		}
+	})
+}
+
+func TestProxyBatchLimits(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.Batch = BatchPolicy{Parallelism: 2, MaxItems: 6}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	items := make([]BatchRequest, 6)
+	for i := range items {
+		items[i] = BatchRequest{URL: service.URL}
+	}
+	six, _ := json.Marshal(items)
+	seven, _ := json.Marshal(append(items, BatchRequest{URL: service.URL}))
+
+	testCases := []struct {
+		name      string
+		body      string
+		accept    string
+		status    int
+		errorCode ErrorCode
+		lines     int
+	}{
+		{name: "ndjson", body: string(six), accept: "application/x-ndjson", status: http.StatusOK, lines: 6},
+		{name: "too many items", body: string(seven), status: http.StatusBadRequest, errorCode: CodeInvalidBatch},
+		{name: "empty batch", body: "[]", status: http.StatusBadRequest, errorCode: CodeInvalidBatch},
+		{name: "not json", body: "{", status: http.StatusBadRequest, errorCode: CodeInvalidBatch},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(tc.body))
+			r.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			proxy.BatchHandler().ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if tc.errorCode != "" {
+				if w.Header().Get("X-Proxy-Error") != string(tc.errorCode) {
+					t.Errorf("expected %s, got %q", tc.errorCode, w.Header().Get("X-Proxy-Error"))
+				}
+				return
+			}
+
+			seen := make(map[int]bool)
+			scanner := bufio.NewScanner(w.Body)
+			for scanner.Scan() {
+				var result BatchResponse
+				if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+					t.Fatalf("bad ndjson line %q: %v", scanner.Text(), err)
+				}
+				if result.Status != http.StatusOK {
+					t.Errorf("item %d: expected status code %d, got %d", result.Index, http.StatusOK, result.Status)
+				}
+				seen[result.Index] = true
+			}
+			if len(seen) != tc.lines {
+				t.Errorf("expected %d lines, got %d", tc.lines, len(seen))
+			}
+			if peak.Load() > 2 {
+				t.Errorf("expected at most 2 concurrent upstream requests, got %d", peak.Load())
+			}
+		})
+	}
+}
+
+func TestProxyBatchItemPanic(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{},
+		WithLogger(slog.New(slog.DiscardHandler)),
+		WithRequestModifier(func(req *http.Request) error {
+			if req.URL.Path == "/boom" {
+				panic("modifier bug")
+			}
+			return nil
+		}),
+	)
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`[
+		{"url": "`+service.URL+`/boom"},
+		{"url": "`+service.URL+`/"}
+	]`))
+	w := httptest.NewRecorder()
+	proxy.BatchHandler().ServeHTTP(w, r)
+
+	var results []BatchResponse
+	json.Unmarshal(w.Body.Bytes(), &results)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %s", w.Body.String())
+	}
+	if results[0].Status != http.StatusInternalServerError || results[0].Error == nil || results[0].Error.Code != CodeInternalError {
+		t.Errorf("expected an internal-error result for the panicking item, got %+v", results[0])
+	}
+	if results[1].Status != http.StatusOK {
+		t.Errorf("expected the other item to succeed, got %+v", results[1])
+	}
+}
+
+func TestProxyBatchBodyLimits(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Path))))
+	}))
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.Batch = BatchPolicy{MaxItemBody: 50, MaxTotalBody: 100}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	long := "/" + strings.Repeat("a", 59)
+	short := "/" + strings.Repeat("b", 39)
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`[
+		{"url": "`+service.URL+long+`"},
+		{"url": "`+service.URL+short+`"},
+		{"url": "`+service.URL+short+`"},
+		{"url": "`+service.URL+short+`"}
+	]`))
+	w := httptest.NewRecorder()
+	proxy.BatchHandler().ServeHTTP(w, r)
+
+	var results []BatchResponse
+	json.Unmarshal(w.Body.Bytes(), &results)
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %s", w.Body.String())
+	}
+
+	if results[0].Error == nil || results[0].Error.Code != CodeResponseTooLarge || !strings.Contains(results[0].Error.Detail, "batch item") {
+		t.Errorf("expected the long item to exceed the item limit, got %+v", results[0])
+	}
+
+	var ok, tooLarge int
+	for _, result := range results[1:] {
+		switch {
+		case result.Status == http.StatusOK && len(result.Body) == 40:
+			ok++
+		case result.Error != nil && result.Error.Code == CodeResponseTooLarge:
+			tooLarge++
+		}
+	}
+	if ok != 2 || tooLarge != 1 {
+		t.Errorf("expected the total limit to admit 2 of 3 short items, got %d ok and %d too large", ok, tooLarge)
+	}
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerConfig sets when a host's circuit opens. It opens after
+// ConsecutiveFailures failures in a row, or when at least MinRequests requests
+// in Window fail at FailureRateThreshold or more. After OpenTimeout,
+// HalfOpenProbes requests are let through to test the host.
+type BreakerConfig struct {
+	ConsecutiveFailures  int
+	FailureRateThreshold float64
+	MinRequests          int
+	Window               time.Duration
+	OpenTimeout          time.Duration
+	HalfOpenProbes       int
+}
+
+// DefaultBreakerConfig returns the breaker settings used when none are
+// configured.
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		ConsecutiveFailures:  5,
+		FailureRateThreshold: 0.5,
+		MinRequests:          20,
+		Window:               30 * time.Second,
+		OpenTimeout:          15 * time.Second,
+		HalfOpenProbes:       1,
+	}
+}
+
+// BreakerOpenError is returned while a host's circuit is open.
+type BreakerOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s", e.Host)
+}
+
+type breaker struct {
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	openedAt    time.Time
+	probes      int
+	successes   int
+	active      int
+	lastUsed    time.Time
+}
+
+type breakerSet struct {
+	cfg       BreakerConfig
+	now       func() time.Time
+	breakers  map[string]*breaker
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func newBreakerSet(cfg BreakerConfig) *breakerSet {
+	if cfg.HalfOpenProbes <= 0 {
+		cfg.HalfOpenProbes = 1
+	}
+
+	return &breakerSet{
+		cfg:      cfg,
+		now:      time.Now,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+func (s *breakerSet) allow(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b := s.breakers[host]
+	if b == nil {
+		b = &breaker{windowStart: now}
+		s.breakers[host] = b
+	}
+	b.lastUsed = now
+
+	switch b.state {
+	case breakerOpen:
+		reopenAt := b.openedAt.Add(s.cfg.OpenTimeout)
+		if now.Before(reopenAt) {
+			return &BreakerOpenError{Host: host, RetryAfter: reopenAt.Sub(now)}
+		}
+		b.state = breakerHalfOpen
+		b.probes = 0
+		b.successes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= s.cfg.HalfOpenProbes {
+			return &BreakerOpenError{Host: host, RetryAfter: time.Second}
+		}
+		b.probes++
+	}
+
+	b.active++
+	return nil
+}
+
+func (s *breakerSet) record(host string, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	b := s.breakers[host]
+	if b == nil {
+		return
+	}
+	b.active--
+	b.lastUsed = now
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			s.trip(b, now)
+			return
+		}
+		b.successes++
+		if b.successes >= s.cfg.HalfOpenProbes {
+			*b = breaker{windowStart: now, active: b.active, lastUsed: now}
+		}
+		return
+	case breakerOpen:
+		return
+	}
+
+	if s.cfg.Window > 0 && now.Sub(b.windowStart) >= s.cfg.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+
+	b.failures++
+	b.consecutive++
+
+	if s.cfg.ConsecutiveFailures > 0 && b.consecutive >= s.cfg.ConsecutiveFailures {
+		s.trip(b, now)
+		return
+	}
+
+	if s.cfg.FailureRateThreshold > 0 && b.requests >= s.cfg.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= s.cfg.FailureRateThreshold {
+		s.trip(b, now)
+	}
+}
+
+func (s *breakerSet) release(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.breakers[host]
+	if b == nil {
+		return
+	}
+	b.active--
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// sweep forgets closed breakers of hosts that have had no requests for a
+// window, so a proxy that sees many hosts does not keep one for each forever.
+func (s *breakerSet) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	idle := max(s.cfg.Window, time.Minute)
+	for host, b := range s.breakers {
+		if b.state == breakerClosed && b.active == 0 && now.Sub(b.lastUsed) >= idle {
+			delete(s.breakers, host)
+		}
+	}
+}
+
+func (s *breakerSet) trip(b *breaker, now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.requests = 0
+	b.failures = 0
+	b.consecutive = 0
+	b.probes = 0
+	b.successes = 0
+}
+
+type breakerStatus struct {
+	Host                string     `json:"host"`
+	State               string     `json:"state"`
+	Requests            int        `json:"requests"`
+	Failures            int        `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+func (s *breakerSet) snapshot() []breakerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]breakerStatus, 0, len(s.breakers))
+	for host, b := range s.breakers {
+		status := breakerStatus{
+			Host:                host,
+			State:               b.state.String(),
+			Requests:            b.requests,
+			Failures:            b.failures,
+			ConsecutiveFailures: b.consecutive,
+		}
+		if b.state != breakerClosed {
+			openedAt := b.openedAt
+			status.OpenedAt = &openedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Host < statuses[j].Host
+	})
+
+	return statuses
+}
+
+func (s *breakerSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.snapshot())
+}
+
+type breakerTransport struct {
+	base     http.RoundTripper
+	breakers *breakerSet
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := t.breakers.allow(host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && errors.Is(err, context.Canceled) && req.Context().Err() != nil {
+		t.breakers.release(host)
+		return nil, err
+	}
+
+	t.breakers.record(host, err != nil || isUpstreamFailureStatus(resp.StatusCode))
+
+	return resp, err
+}
+
+func isUpstreamFailureStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
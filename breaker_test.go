@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerStateTransitions(t *testing.T) {
+	now := time.Unix(0, 0)
+	set := newBreakerSet(BreakerConfig{
+		ConsecutiveFailures: 3,
+		OpenTimeout:         10 * time.Second,
+		HalfOpenProbes:      1,
+	})
+	set.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if err := set.allow("example.com"); err != nil {
+			t.Fatalf("attempt %d: expected closed breaker to allow, got %v", i, err)
+		}
+		set.record("example.com", true)
+	}
+
+	err := set.allow("example.com")
+	openErr, ok := err.(*BreakerOpenError)
+	if !ok {
+		t.Fatalf("expected breaker to be open, got %v", err)
+	}
+	if openErr.RetryAfter != 10*time.Second {
+		t.Errorf("expected retry after 10s, got %s", openErr.RetryAfter)
+	}
+
+	now = now.Add(10 * time.Second)
+	if err := set.allow("example.com"); err != nil {
+		t.Fatalf("expected half-open breaker to allow a probe, got %v", err)
+	}
+	if err := set.allow("example.com"); err == nil {
+		t.Fatal("expected half-open breaker to reject requests beyond the probe limit")
+	}
+
+	set.record("example.com", false)
+	if state := set.snapshot()[0].State; state != "closed" {
+		t.Errorf("expected breaker to close after successful probe, got %s", state)
+	}
+
+	if err := set.allow("other.com"); err != nil {
+		t.Errorf("expected breakers to be isolated per host, got %v", err)
+	}
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	set := newBreakerSet(BreakerConfig{
+		FailureRateThreshold: 0.5,
+		MinRequests:          4,
+		Window:               time.Minute,
+		OpenTimeout:          time.Minute,
+	})
+
+	outcomes := []bool{false, true, false, true}
+	for _, failed := range outcomes {
+		if err := set.allow("example.com"); err != nil {
+			t.Fatalf("expected breaker to allow, got %v", err)
+		}
+		set.record("example.com", failed)
+	}
+
+	if err := set.allow("example.com"); err == nil {
+		t.Fatal("expected breaker to open once failure rate reaches the threshold")
+	}
+}
+
+func TestBreakerEvictsIdleHosts(t *testing.T) {
+	now := time.Unix(0, 0)
+	set := newBreakerSet(BreakerConfig{
+		ConsecutiveFailures: 1,
+		Window:              time.Minute,
+		OpenTimeout:         time.Hour,
+	})
+	set.now = func() time.Time { return now }
+
+	for _, host := range []string{"idle.com", "open.com", "busy.com"} {
+		if err := set.allow(host); err != nil {
+			t.Fatalf("%s: expected breaker to allow, got %v", host, err)
+		}
+	}
+	set.record("idle.com", false)
+	set.record("open.com", true)
+
+	now = now.Add(2 * time.Minute)
+	if err := set.allow("new.com"); err != nil {
+		t.Fatalf("expected breaker to allow, got %v", err)
+	}
+	set.record("new.com", false)
+
+	var hosts []string
+	for _, status := range set.snapshot() {
+		hosts = append(hosts, status.Host)
+	}
+	want := []string{"busy.com", "new.com", "open.com"}
+	if fmt.Sprint(hosts) != fmt.Sprint(want) {
+		t.Errorf("expected breakers for %v after the sweep, got %v", want, hosts)
+	}
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	t.Run("fast fails with 503 while open", func(t *testing.T) {
+		var hits atomic.Int64
+		service := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.WriteHeader(http.StatusBadGateway)
+			}),
+		)
+		defer service.Close()
+
+		proxy := NewProxy(&http.Client{}, WithCircuitBreaker(BreakerConfig{
+			ConsecutiveFailures: 2,
+			OpenTimeout:         30 * time.Second,
+		}))
+
+		for i := 0; i < 2; i++ {
+			w := newMockResponseWriter()
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("request %d: expected status code %d, got %d", i, http.StatusBadGateway, w.Code)
+			}
+		}
+
+		w := newMockResponseWriter()
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+		proxy.ServeHTTP(w, r)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != "30" {
+			t.Errorf("expected Retry-After 30, got %q", retryAfter)
+		}
+		if hits.Load() != 2 {
+			t.Errorf("expected upstream to be hit twice, got %d", hits.Load())
+		}
+	})
+
+	t.Run("exposes breaker state", func(t *testing.T) {
+		service := httptest.NewServer(http.NotFoundHandler())
+		service.Close()
+
+		proxy := NewProxy(&http.Client{}, WithCircuitBreaker(BreakerConfig{
+			ConsecutiveFailures: 1,
+			OpenTimeout:         time.Minute,
+		}))
+
+		w := newMockResponseWriter()
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+		proxy.ServeHTTP(w, r)
+
+		admin := httptest.NewRecorder()
+		proxy.BreakerHandler().ServeHTTP(admin, httptest.NewRequest(http.MethodGet, "/admin/breakers", nil))
+
+		var statuses []breakerStatus
+		if err := json.NewDecoder(admin.Body).Decode(&statuses); err != nil {
+			t.Fatalf("failed to decode breaker state: %v", err)
+		}
+
+		serviceURL, _ := url.Parse(service.URL)
+		if len(statuses) != 1 || statuses[0].Host != serviceURL.Host || statuses[0].State != "open" {
+			t.Errorf("expected open breaker for %s, got %+v", serviceURL.Host, statuses)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/abdigaliarsen/proxy"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	overrides, err := proxy.ParseConfigOverrides(os.Args[1:], os.Getenv)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := proxy.LoadConfig(overrides)
+	if err != nil {
+		return err
+	}
+
+	level := new(slog.LevelVar)
+	logger := proxy.NewLogger(cfg.Logging, level)
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	sessions := proxy.NewMemorySessionStore()
+	if cfg.Session.StateFile != "" {
+		sessions, err = proxy.LoadMemorySessionStore(cfg.Session.StateFile)
+		if err != nil {
+			return fmt.Errorf("session state: %w", err)
+		}
+	}
+
+	px := proxy.NewProxy(&http.Client{},
+		proxy.WithCircuitBreaker(proxy.DefaultBreakerConfig()),
+		proxy.WithPolicy(cfg.Policy()),
+		proxy.WithLogger(logger),
+		proxy.WithSessionStore(sessions),
+	)
+
+	if path := cfg.Session.StateFile; path != "" {
+		px.OnDrained(func(context.Context) error {
+			if err := sessions.Save(path); err != nil {
+				return fmt.Errorf("session state: %w", err)
+			}
+			logger.Info("session state saved", "path", path, "sessions", sessions.Len())
+			return nil
+		})
+	}
+
+	router := chi.NewRouter()
+
+	var auth *proxy.AuthMiddleware
+	if cfg.Auth != nil {
+		authenticators, err := cfg.Auth.Authenticators()
+		if err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+		auth = proxy.NewAuthMiddleware(cmp.Or(cfg.Auth.Realm, "proxy"), authenticators...)
+		router.With(auth.Handler).Handle("/proxy/*", px)
+		router.With(auth.Handler).Post("/batch", px.BatchHandler().ServeHTTP)
+	} else {
+		router.Handle("/proxy/*", px)
+		router.Post("/batch", px.BatchHandler().ServeHTTP)
+	}
+
+	router.Handle("/p/*", px)
+	router.Handle("/readyz", px.ReadyHandler())
+
+	if cfg.Admin != nil {
+		admin := chi.NewRouter()
+		admin.Handle("/admin/breakers", px.BreakerHandler())
+		admin.Handle("/admin/queues", px.QueueHandler())
+		admin.Handle("/readyz", px.ReadyHandler())
+
+		ln, err := net.Listen("tcp", cfg.Admin.Address)
+		if err != nil {
+			return err
+		}
+		logger.Info("listening for admin requests", "address", ln.Addr().String())
+
+		srv := &http.Server{Handler: admin}
+		defer srv.Close()
+		go func() {
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+		go func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("admin listener failed", "error", err)
+			}
+		}()
+	}
+
+	var listeners []net.Listener
+	for _, l := range cfg.Listeners {
+		ln, err := net.Listen("tcp", l.Address)
+		if err != nil {
+			return err
+		}
+
+		if l.TLS != nil {
+			tlsConfig, err := proxy.NewTLSServerConfig(*l.TLS)
+			if err != nil {
+				return fmt.Errorf("listener %s: %w", l.Address, err)
+			}
+			ln = tls.NewListener(ln, tlsConfig)
+
+			if l.TLS.Dev {
+				logger.Warn("serving development certificates, trust the generated CA to avoid browser warnings",
+					"ca", filepath.Join(l.TLS.DevCertDir(), "ca.pem"))
+			}
+		}
+
+		logger.Info("listening", "address", ln.Addr().String(), "tls", l.TLS != nil)
+		listeners = append(listeners, ln)
+	}
+
+	if cfg.SOCKS != nil {
+		ln, err := net.Listen("tcp", cfg.SOCKS.Address)
+		if err != nil {
+			return err
+		}
+		logger.Info("listening for socks5", "address", ln.Addr().String())
+
+		socks := proxy.NewSOCKSServer(px, cfg.SOCKS.Users, cfg.SOCKS.SessionJar)
+		defer socks.Close()
+		go func() {
+			<-ctx.Done()
+			socks.Shutdown()
+		}()
+		go func() {
+			if err := socks.Serve(ln); err != nil {
+				logger.Error("socks5 listener failed", "error", err)
+			}
+		}()
+	}
+
+	if overrides.Path != "" {
+		go proxy.WatchConfig(ctx, overrides.Path, 2*time.Second, func() {
+			next, err := proxy.LoadConfig(overrides)
+			if err != nil {
+				logger.Error("configuration reload failed, keeping previous configuration", "error", err)
+				return
+			}
+
+			if auth != nil && next.Auth != nil {
+				authenticators, err := next.Auth.Authenticators()
+				if err != nil {
+					logger.Error("configuration reload failed, keeping previous configuration", "error", err)
+					return
+				}
+				auth.Update(authenticators...)
+			}
+			if (auth == nil) != (next.Auth == nil) {
+				logger.Warn("enabling or disabling auth takes effect after a restart")
+			}
+
+			px.SetPolicy(next.Policy())
+			proxy.NewLogger(next.Logging, level)
+
+			if !reflect.DeepEqual(next.Listeners, cfg.Listeners) {
+				logger.Warn("listener changes take effect after a restart")
+			}
+
+			logger.Info("configuration reloaded", "path", overrides.Path)
+		})
+	}
+
+	return proxy.RunServer(ctx, proxy.NewServer(router, cfg.HTTP2), px, cfg.DrainConfig(), listeners...)
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HostConcurrency overrides the in-flight limit for hosts matching Host.
+type HostConcurrency struct {
+	Host        string `json:"host"`
+	MaxInFlight int    `json:"max_in_flight"`
+}
+
+// ConcurrencyLimits caps the requests in flight to each upstream host. Zero
+// means no limit. Requests over the limit queue for up to QueueTimeout.
+type ConcurrencyLimits struct {
+	MaxInFlight   int
+	HostOverrides []HostConcurrency
+	QueueTimeout  time.Duration
+}
+
+func (l ConcurrencyLimits) forHost(host string) int {
+	for _, override := range l.HostOverrides {
+		if matchHost(override.Host, host) {
+			return override.MaxInFlight
+		}
+	}
+	return l.MaxInFlight
+}
+
+// QueueTimeoutError is returned when a request waited QueueTimeout without
+// getting a slot to its host.
+type QueueTimeoutError struct {
+	Host   string
+	Waited time.Duration
+}
+
+func (e *QueueTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for a connection slot to %s", e.Waited, e.Host)
+}
+
+type concurrencyWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+type hostQueue struct {
+	limit    int
+	inFlight int
+	queued   int
+	waiting  map[string][]*concurrencyWaiter
+	order    []string
+	timeouts int
+}
+
+func (q *hostQueue) dispatch() {
+	for q.inFlight < q.limit && q.queued > 0 {
+		session := q.order[0]
+		q.order = q.order[1:]
+
+		waiters := q.waiting[session]
+		w := waiters[0]
+		if len(waiters) > 1 {
+			q.waiting[session] = waiters[1:]
+			q.order = append(q.order, session)
+		} else {
+			delete(q.waiting, session)
+		}
+
+		q.queued--
+		q.inFlight++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+func (q *hostQueue) remove(session string, w *concurrencyWaiter) {
+	waiters := slices.DeleteFunc(q.waiting[session], func(other *concurrencyWaiter) bool {
+		return other == w
+	})
+	q.queued--
+
+	if len(waiters) > 0 {
+		q.waiting[session] = waiters
+		return
+	}
+
+	delete(q.waiting, session)
+	q.order = slices.DeleteFunc(q.order, func(other string) bool {
+		return other == session
+	})
+}
+
+type concurrencyLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*hostQueue
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{hosts: make(map[string]*hostQueue)}
+}
+
+func (l *concurrencyLimiter) acquire(ctx context.Context, host, session string, limit int, timeout time.Duration) (func(), error) {
+	l.mu.Lock()
+
+	q, ok := l.hosts[host]
+	if !ok {
+		q = &hostQueue{waiting: make(map[string][]*concurrencyWaiter)}
+		l.hosts[host] = q
+	}
+	q.limit = limit
+
+	if q.inFlight < limit && q.queued == 0 {
+		q.inFlight++
+		l.mu.Unlock()
+		return l.releaser(host, q), nil
+	}
+
+	w := &concurrencyWaiter{ready: make(chan struct{})}
+	if len(q.waiting[session]) == 0 {
+		q.order = append(q.order, session)
+	}
+	q.waiting[session] = append(q.waiting[session], w)
+	q.queued++
+	q.dispatch()
+	l.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return l.releaser(host, q), nil
+	case <-expired:
+		err = &QueueTimeoutError{Host: host, Waited: timeout}
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if w.granted {
+		q.inFlight--
+		q.dispatch()
+	} else {
+		q.remove(session, w)
+	}
+	l.forget(host, q)
+
+	if _, ok := err.(*QueueTimeoutError); ok {
+		q.timeouts++
+	}
+
+	return nil, err
+}
+
+func (l *concurrencyLimiter) releaser(host string, q *hostQueue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			q.inFlight--
+			q.dispatch()
+			l.forget(host, q)
+		})
+	}
+}
+
+// forget drops the queue of a host with nothing in flight or waiting, so the
+// limiter only holds entries for hosts that are in use. Callers hold l.mu.
+func (l *concurrencyLimiter) forget(host string, q *hostQueue) {
+	if q.inFlight == 0 && q.queued == 0 && l.hosts[host] == q {
+		delete(l.hosts, host)
+	}
+}
+
+type queueStatus struct {
+	Host           string `json:"host"`
+	MaxInFlight    int    `json:"max_in_flight"`
+	InFlight       int    `json:"in_flight"`
+	Queued         int    `json:"queued"`
+	QueuedSessions int    `json:"queued_sessions"`
+	QueueTimeouts  int    `json:"queue_timeouts"`
+}
+
+func (l *concurrencyLimiter) snapshot() []queueStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	statuses := make([]queueStatus, 0, len(l.hosts))
+	for host, q := range l.hosts {
+		statuses = append(statuses, queueStatus{
+			Host:           host,
+			MaxInFlight:    q.limit,
+			InFlight:       q.inFlight,
+			Queued:         q.queued,
+			QueuedSessions: len(q.order),
+			QueueTimeouts:  q.timeouts,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Host < statuses[j].Host
+	})
+
+	return statuses
+}
+
+func (l *concurrencyLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.snapshot())
+}
+
+type concurrencyTransport struct {
+	base    http.RoundTripper
+	limiter *concurrencyLimiter
+	limits  ConcurrencyLimits
+}
+
+func (t *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limit := t.limits.forHost(req.URL.Host)
+	if limit <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	release, err := t.limiter.acquire(req.Context(), req.URL.Host, sessionFromContext(req.Context()), limit, t.limits.QueueTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitForQueued(t *testing.T, l *concurrencyLimiter, host string, queued int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, status := range l.snapshot() {
+			if status.Host == host && status.Queued == queued {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d queued requests to %s", queued, host)
+}
+
+func TestConcurrencyLimiterFairQueue(t *testing.T) {
+	l := newConcurrencyLimiter()
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "example.com", "holder", 1, 0)
+	if err != nil {
+		t.Fatalf("failed to acquire first slot: %v", err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+
+	enqueue := func(session string, n int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release, err := l.acquire(ctx, "example.com", session, 1, 0)
+			if err != nil {
+				t.Errorf("acquire for %s failed: %v", session, err)
+				return
+			}
+
+			mu.Lock()
+			order = append(order, session)
+			mu.Unlock()
+			release()
+		}()
+		waitForQueued(t, l, "example.com", n)
+	}
+
+	enqueue("noisy", 1)
+	enqueue("noisy", 2)
+	enqueue("noisy", 3)
+	enqueue("quiet", 4)
+
+	release()
+	wg.Wait()
+
+	expected := []string{"noisy", "quiet", "noisy", "noisy"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("expected round-robin order %v, got %v", expected, order)
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	l := newConcurrencyLimiter()
+
+	release, _ := l.acquire(context.Background(), "example.com", "a", 1, 0)
+	defer release()
+
+	_, err := l.acquire(context.Background(), "example.com", "b", 1, 20*time.Millisecond)
+	if _, ok := err.(*QueueTimeoutError); !ok {
+		t.Fatalf("expected queue timeout error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.acquire(ctx, "example.com", "c", 1, 0); err != context.Canceled {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+
+	status := l.snapshot()[0]
+	if status.InFlight != 1 || status.Queued != 0 || status.QueueTimeouts != 1 {
+		t.Errorf("expected 1 in flight, 0 queued and 1 timeout, got %+v", status)
+	}
+}
+
+func TestConcurrencyLimiterForgetsIdleHosts(t *testing.T) {
+	l := newConcurrencyLimiter()
+
+	release, err := l.acquire(context.Background(), "example.com", "a", 1, 0)
+	if err != nil {
+		t.Fatalf("failed to acquire slot: %v", err)
+	}
+	if _, err := l.acquire(context.Background(), "example.com", "b", 1, 10*time.Millisecond); err == nil {
+		t.Fatal("expected the second request to time out")
+	}
+	if statuses := l.snapshot(); len(statuses) != 1 {
+		t.Fatalf("expected the host to stay while a request is in flight, got %+v", statuses)
+	}
+
+	release()
+	if statuses := l.snapshot(); len(statuses) != 0 {
+		t.Errorf("expected idle host to be forgotten, got %+v", statuses)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release, _ = l.acquire(context.Background(), "example.com", "a", 1, 0)
+	l.acquire(ctx, "example.com", "b", 1, 0)
+	release()
+	if statuses := l.snapshot(); len(statuses) != 0 {
+		t.Errorf("expected idle host to be forgotten after a canceled wait, got %+v", statuses)
+	}
+}
+
+func TestProxyConcurrencyLimit(t *testing.T) {
+	var inFlight, peak atomic.Int64
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			w.Write([]byte(mockExpectedResponseBody))
+		}),
+	)
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.Concurrency = ConcurrencyLimits{MaxInFlight: 3}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for session := 0; session < 10; session++ {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+				r.AddCookie(&http.Cookie{Name: proxySessionCookie, Value: fmt.Sprint(session)})
+				w := newMockResponseWriter()
+				proxy.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					failed.Add(1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	if failed.Load() != 0 {
+		t.Errorf("expected all queued requests to succeed, %d failed", failed.Load())
+	}
+	if peak.Load() > 3 {
+		t.Errorf("expected at most 3 requests in flight, got %d", peak.Load())
+	}
+}
+
+func TestProxyConcurrencyQueueTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-unblock
+		}),
+	)
+	defer service.Close()
+	defer close(unblock)
+
+	policy := DefaultPolicy()
+	policy.Concurrency = ConcurrencyLimits{
+		HostOverrides: []HostConcurrency{{Host: "127.0.0.1", MaxInFlight: 1}},
+		QueueTimeout:  20 * time.Millisecond,
+	}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	go proxy.ServeHTTP(newMockResponseWriter(), httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+	waitForQueued(t, proxy.queues, service.Listener.Addr().String(), 0)
+
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.QueueHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/queues", nil))
+
+	var statuses []queueStatus
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatalf("failed to decode queue status: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].InFlight != 1 || statuses[0].QueueTimeouts != 1 {
+		t.Errorf("expected one busy host with one queue timeout, got %+v", statuses)
+	}
+}
@@ -0,0 +1,664 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Duration is a time.Duration written in JSON as a string such as "10s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// ListenerConfig is an HTTP listener. With TLS set it serves HTTPS.
+type ListenerConfig struct {
+	Address string     `json:"address"`
+	TLS     *TLSConfig `json:"tls,omitempty"`
+}
+
+// PhaseTimeouts is the JSON form of Timeouts.
+type PhaseTimeouts struct {
+	Dial           Duration `json:"dial,omitempty"`
+	TLSHandshake   Duration `json:"tls_handshake,omitempty"`
+	ResponseHeader Duration `json:"response_header,omitempty"`
+	IdleBody       Duration `json:"idle_body,omitempty"`
+	Total          Duration `json:"total,omitempty"`
+}
+
+func (t PhaseTimeouts) timeouts() Timeouts {
+	return Timeouts{
+		Dial:           time.Duration(t.Dial),
+		TLSHandshake:   time.Duration(t.TLSHandshake),
+		ResponseHeader: time.Duration(t.ResponseHeader),
+		IdleBody:       time.Duration(t.IdleBody),
+		Total:          time.Duration(t.Total),
+	}
+}
+
+// HostTimeouts overrides the timeouts for hosts matching Host.
+type HostTimeouts struct {
+	Host string `json:"host"`
+	PhaseTimeouts
+}
+
+// TimeoutsConfig is the JSON form of TimeoutConfig.
+type TimeoutsConfig struct {
+	Default   PhaseTimeouts  `json:"default"`
+	Overrides []HostTimeouts `json:"overrides,omitempty"`
+}
+
+// SessionConfig sets the session cookie. With StateFile set, sessions are
+// loaded at start and saved when the proxy drains.
+type SessionConfig struct {
+	MaxAge    Duration `json:"max_age"`
+	Secure    bool     `json:"secure"`
+	StateFile string   `json:"state_file,omitempty"`
+}
+
+// UpstreamRuleConfig routes hosts matching Hosts through Proxies, tried in
+// order. A proxy is an http, https, socks5 or socks5h URL, or DIRECT.
+type UpstreamRuleConfig struct {
+	Hosts   []string `json:"hosts"`
+	Proxies []string `json:"proxies"`
+}
+
+// UpstreamConfig holds the upstream proxy rules. Proxy adds a catch-all rule
+// after Rules.
+type UpstreamConfig struct {
+	Proxy string               `json:"proxy,omitempty"`
+	Rules []UpstreamRuleConfig `json:"rules,omitempty"`
+}
+
+func (c UpstreamConfig) rules() ([]UpstreamRule, error) {
+	raw := c.Rules
+	if c.Proxy != "" {
+		raw = append(raw[:len(raw):len(raw)], UpstreamRuleConfig{Hosts: []string{"*"}, Proxies: []string{c.Proxy}})
+	}
+
+	var errs []error
+	rules := make([]UpstreamRule, 0, len(raw))
+	for i, r := range raw {
+		rule := UpstreamRule{Hosts: r.Hosts}
+
+		if len(r.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("rules[%d]: at least one host pattern is required", i))
+		}
+		for _, pattern := range r.Hosts {
+			if err := validHostPattern(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d]: %w", i, err))
+			}
+		}
+
+		if len(r.Proxies) == 0 {
+			errs = append(errs, fmt.Errorf("rules[%d]: at least one proxy or DIRECT is required", i))
+		}
+		for _, proxy := range r.Proxies {
+			u, err := parseUpstreamProxy(proxy)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d]: %w", i, err))
+			}
+			rule.Proxies = append(rule.Proxies, u)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// LoggingConfig sets the log level (debug, info, warn or error) and format
+// (text or json).
+type LoggingConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// SOCKSConfig is the SOCKS5 listener. Users maps user names to passwords;
+// SessionJar serves plain HTTP over tunnels with a cookie jar per user.
+type SOCKSConfig struct {
+	Address    string            `json:"address"`
+	Users      map[string]string `json:"users,omitempty"`
+	SessionJar bool              `json:"session_jar,omitempty"`
+}
+
+// AdminConfig is the listener for the admin endpoints.
+type AdminConfig struct {
+	Address string `json:"address"`
+}
+
+// AuthConfig enables client authentication. At least one of Htpasswd,
+// APIKeys and JWT is required.
+type AuthConfig struct {
+	Realm    string            `json:"realm,omitempty"`
+	Htpasswd string            `json:"htpasswd,omitempty"`
+	APIKeys  map[string]string `json:"api_keys,omitempty"`
+	JWT      *JWTConfig        `json:"jwt,omitempty"`
+}
+
+// Authenticators builds the configured authenticators, in the order
+// htpasswd, API keys, JWT.
+func (c *AuthConfig) Authenticators() ([]Authenticator, error) {
+	var authenticators []Authenticator
+
+	if c.Htpasswd != "" {
+		htpasswd, err := LoadHtpasswd(c.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, htpasswd)
+	}
+
+	if len(c.APIKeys) > 0 {
+		authenticators = append(authenticators, NewAPIKeyAuthenticator(c.APIKeys))
+	}
+
+	if c.JWT != nil {
+		jwt, err := LoadJWTAuthenticator(*c.JWT)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+
+	return authenticators, nil
+}
+
+// RateLimitsConfig is the JSON form of RateLimits.
+type RateLimitsConfig struct {
+	Client        *RateLimit      `json:"client,omitempty"`
+	Session       *RateLimit      `json:"session,omitempty"`
+	Principal     *RateLimit      `json:"principal,omitempty"`
+	Host          *RateLimit      `json:"host,omitempty"`
+	HostOverrides []HostRateLimit `json:"host_overrides,omitempty"`
+	HostQueue     Duration        `json:"host_queue,omitempty"`
+}
+
+// ConcurrencyConfig is the JSON form of ConcurrencyLimits.
+type ConcurrencyConfig struct {
+	MaxInFlight   int               `json:"max_in_flight,omitempty"`
+	HostOverrides []HostConcurrency `json:"host_overrides,omitempty"`
+	QueueTimeout  Duration          `json:"queue_timeout,omitempty"`
+}
+
+// ErrorsConfig sets the html/template file used for error pages sent to
+// browsers.
+type ErrorsConfig struct {
+	HTMLPage string `json:"html_page,omitempty"`
+}
+
+func (c ErrorsConfig) page() (*template.Template, error) {
+	if c.HTMLPage == "" {
+		return nil, nil
+	}
+	return template.ParseFiles(c.HTMLPage)
+}
+
+// ShutdownConfig is the JSON form of DrainConfig.
+type ShutdownConfig struct {
+	ReadinessGrace Duration `json:"readiness_grace"`
+	Timeout        Duration `json:"timeout"`
+}
+
+// Config is the configuration file of the proxy command. Policy turns it into
+// the Policy the Proxy applies.
+type Config struct {
+	Listeners    []ListenerConfig  `json:"listeners"`
+	SOCKS        *SOCKSConfig      `json:"socks,omitempty"`
+	Admin        *AdminConfig      `json:"admin,omitempty"`
+	Auth         *AuthConfig       `json:"auth,omitempty"`
+	Timeouts     TimeoutsConfig    `json:"timeouts"`
+	Session      SessionConfig     `json:"session"`
+	Hosts        HostPolicy        `json:"hosts"`
+	Upstream     UpstreamConfig    `json:"upstream"`
+	RateLimit    RateLimitsConfig  `json:"rate_limit"`
+	Concurrency  ConcurrencyConfig `json:"concurrency"`
+	Limits       BodyLimits        `json:"limits"`
+	ContentTypes []ContentTypeRule `json:"content_types,omitempty"`
+	Errors       ErrorsConfig      `json:"errors"`
+	Compression  CompressionPolicy `json:"compression"`
+	HTTP2        HTTP2Config       `json:"http2"`
+	GRPC         GRPCPolicy        `json:"grpc"`
+	Resume       ResumePolicy      `json:"resume"`
+	Headers      []HeaderRule      `json:"headers,omitempty"`
+	Transforms   []TransformConfig `json:"transforms,omitempty"`
+	Targets      TargetPolicy      `json:"targets"`
+	Batch        BatchPolicy       `json:"batch"`
+	Politeness   PolitenessConfig  `json:"politeness"`
+	Logging      LoggingConfig     `json:"logging"`
+	Shutdown     ShutdownConfig    `json:"shutdown"`
+}
+
+// DefaultConfig returns the configuration used for fields the file leaves out.
+func DefaultConfig() *Config {
+	return &Config{
+		Listeners: []ListenerConfig{{Address: ":8080"}},
+		Timeouts: TimeoutsConfig{
+			Default: PhaseTimeouts{
+				Dial:           Duration(3 * time.Second),
+				TLSHandshake:   Duration(5 * time.Second),
+				ResponseHeader: Duration(10 * time.Second),
+				IdleBody:       Duration(30 * time.Second),
+				Total:          Duration(2 * time.Minute),
+			},
+		},
+		Session: SessionConfig{
+			MaxAge: Duration(time.Hour),
+			Secure: true,
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Shutdown: ShutdownConfig{
+			ReadinessGrace: Duration(5 * time.Second),
+			Timeout:        Duration(30 * time.Second),
+		},
+	}
+}
+
+// Validate checks the whole configuration and reports every problem, each
+// prefixed with its field.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if len(c.Listeners) == 0 {
+		fail("listeners", "at least one listener is required")
+	}
+	for i, l := range c.Listeners {
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			fail(fmt.Sprintf("listeners[%d].address", i), "%v", err)
+		}
+		if l.TLS != nil {
+			if err := l.TLS.validate(); err != nil {
+				fail(fmt.Sprintf("listeners[%d].tls", i), "%v", err)
+			}
+		}
+	}
+
+	if c.SOCKS != nil {
+		if _, _, err := net.SplitHostPort(c.SOCKS.Address); err != nil {
+			fail("socks.address", "%v", err)
+		}
+		for user, password := range c.SOCKS.Users {
+			if user == "" || len(user) > 255 || len(password) > 255 {
+				fail("socks.users", "user names and passwords must be 1 to 255 bytes long")
+				break
+			}
+		}
+		if c.SOCKS.SessionJar && len(c.SOCKS.Users) == 0 {
+			fail("socks.session_jar", "requires users, sessions are keyed by user name")
+		}
+		if c.Auth != nil && len(c.SOCKS.Users) == 0 {
+			fail("socks.users", "required when auth is configured, the SOCKS5 listener does not use auth")
+		}
+	}
+
+	if c.Admin != nil {
+		if _, _, err := net.SplitHostPort(c.Admin.Address); err != nil {
+			fail("admin.address", "%v", err)
+		}
+	}
+
+	if c.Auth != nil {
+		if c.Auth.Htpasswd == "" && len(c.Auth.APIKeys) == 0 && c.Auth.JWT == nil {
+			fail("auth", "at least one of htpasswd, api_keys or jwt is required")
+		}
+		if c.Auth.JWT != nil && c.Auth.JWT.JWKS == "" {
+			fail("auth.jwt.jwks", "is required")
+		}
+	}
+
+	phases := map[string]PhaseTimeouts{"timeouts.default": c.Timeouts.Default}
+	for i, o := range c.Timeouts.Overrides {
+		field := fmt.Sprintf("timeouts.overrides[%d]", i)
+		phases[field] = o.PhaseTimeouts
+		if err := validHostPattern(o.Host); err != nil {
+			fail(field+".host", "%v", err)
+		}
+	}
+	for field, t := range phases {
+		if t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.IdleBody < 0 || t.Total < 0 {
+			fail(field, "timeouts must not be negative")
+		}
+	}
+
+	if c.Session.MaxAge <= 0 {
+		fail("session.max_age", "must be positive")
+	}
+
+	if err := c.Hosts.validate(); err != nil {
+		fail("hosts", "%v", err)
+	}
+
+	if _, err := c.Upstream.rules(); err != nil {
+		fail("upstream", "%v", err)
+	}
+
+	limits := map[string]*RateLimit{
+		"rate_limit.client":    c.RateLimit.Client,
+		"rate_limit.session":   c.RateLimit.Session,
+		"rate_limit.principal": c.RateLimit.Principal,
+		"rate_limit.host":      c.RateLimit.Host,
+	}
+	for i, o := range c.RateLimit.HostOverrides {
+		field := fmt.Sprintf("rate_limit.host_overrides[%d]", i)
+		limits[field] = &o.RateLimit
+		if err := validHostPattern(o.Host); err != nil {
+			fail(field+".host", "%v", err)
+		}
+	}
+	for field, l := range limits {
+		if l == nil {
+			continue
+		}
+		if err := l.validate(); err != nil {
+			fail(field, "%v", err)
+		}
+	}
+	if c.RateLimit.HostQueue < 0 {
+		fail("rate_limit.host_queue", "must not be negative")
+	}
+
+	if c.Concurrency.MaxInFlight < 0 {
+		fail("concurrency.max_in_flight", "must not be negative")
+	}
+	for i, o := range c.Concurrency.HostOverrides {
+		field := fmt.Sprintf("concurrency.host_overrides[%d]", i)
+		if err := validHostPattern(o.Host); err != nil {
+			fail(field+".host", "%v", err)
+		}
+		if o.MaxInFlight < 0 {
+			fail(field+".max_in_flight", "must not be negative")
+		}
+	}
+	if c.Concurrency.QueueTimeout < 0 {
+		fail("concurrency.queue_timeout", "must not be negative")
+	}
+
+	if c.Limits.MaxRequestBody < 0 || c.Limits.MaxResponseBody < 0 {
+		fail("limits", "body limits must not be negative")
+	}
+	for i, rule := range c.ContentTypes {
+		if err := rule.validate(); err != nil {
+			fail(fmt.Sprintf("content_types[%d]", i), "%v", err)
+		}
+	}
+
+	if c.Compression.MinSize < 0 {
+		fail("compression.min_size", "must not be negative")
+	}
+	for _, pattern := range c.Compression.ContentTypes {
+		if err := validMediaTypePattern(pattern); err != nil {
+			fail("compression.content_types", "%v", err)
+		}
+	}
+
+	for _, pattern := range c.HTTP2.Upstream.H2CHosts {
+		if err := validHostPattern(pattern); err != nil {
+			fail("http2.upstream.h2c_hosts", "%v", err)
+		}
+	}
+
+	for i, rule := range c.Headers {
+		if _, err := rule.compile(); err != nil {
+			fail(fmt.Sprintf("headers[%d]", i), "%v", err)
+		}
+	}
+
+	for i, t := range c.Transforms {
+		if _, err := t.rule(); err != nil {
+			fail(fmt.Sprintf("transforms[%d]", i), "%v", err)
+		}
+	}
+
+	if err := c.Targets.validate(); err != nil {
+		fail("targets", "%v", err)
+	}
+
+	if err := c.Politeness.validate(); err != nil {
+		fail("politeness", "%v", err)
+	}
+
+	if err := c.Batch.validate(); err != nil {
+		fail("batch", "%v", err)
+	}
+
+	if c.Resume.MaxAttempts < 0 {
+		fail("resume.max_attempts", "must not be negative")
+	}
+
+	if _, err := c.Errors.page(); err != nil {
+		fail("errors.html_page", "%v", err)
+	}
+
+	if _, err := parseLogLevel(c.Logging.Level); err != nil {
+		fail("logging.level", "%v", err)
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		fail("logging.format", "must be \"text\" or \"json\", got %q", c.Logging.Format)
+	}
+
+	if c.Shutdown.ReadinessGrace < 0 || c.Shutdown.Timeout <= 0 {
+		fail("shutdown", "readiness_grace must not be negative and timeout must be positive")
+	}
+
+	slices.SortFunc(errs, func(a, b error) int {
+		return strings.Compare(a.Error(), b.Error())
+	})
+
+	return errors.Join(errs...)
+}
+
+// Policy returns the Policy for c. c must have passed Validate.
+func (c *Config) Policy() *Policy {
+	policy := &Policy{
+		Timeouts: TimeoutConfig{Default: c.Timeouts.Default.timeouts()},
+		Hosts:    c.Hosts,
+		Session: SessionPolicy{
+			MaxAge: time.Duration(c.Session.MaxAge),
+			Secure: c.Session.Secure,
+		},
+		RateLimits: RateLimits{
+			Client:        c.RateLimit.Client,
+			Session:       c.RateLimit.Session,
+			Principal:     c.RateLimit.Principal,
+			Host:          c.RateLimit.Host,
+			HostOverrides: c.RateLimit.HostOverrides,
+			HostQueue:     time.Duration(c.RateLimit.HostQueue),
+		},
+		Concurrency: ConcurrencyLimits{
+			MaxInFlight:   c.Concurrency.MaxInFlight,
+			HostOverrides: c.Concurrency.HostOverrides,
+			QueueTimeout:  time.Duration(c.Concurrency.QueueTimeout),
+		},
+		Limits:       c.Limits,
+		ContentTypes: c.ContentTypes,
+		Compression:  c.Compression,
+		HTTP2:        c.HTTP2.Upstream,
+		GRPC:         c.GRPC,
+		Resume:       c.Resume,
+		Targets:      c.Targets,
+		Batch:        c.Batch,
+		Politeness: Politeness{
+			Enabled:   c.Politeness.Enabled,
+			UserAgent: c.Politeness.UserAgent,
+			Hosts:     c.Politeness.Hosts,
+			MinDelay:  time.Duration(c.Politeness.MinDelay),
+			MaxDelay:  time.Duration(c.Politeness.MaxDelay),
+			RobotsTTL: time.Duration(c.Politeness.RobotsTTL),
+		},
+	}
+
+	for _, o := range c.Timeouts.Overrides {
+		policy.Timeouts.Overrides = append(policy.Timeouts.Overrides, TimeoutOverride{
+			Host:     o.Host,
+			Timeouts: o.timeouts(),
+		})
+	}
+
+	policy.Upstream, _ = c.Upstream.rules()
+	policy.ErrorPage, _ = c.Errors.page()
+	policy.Headers, _ = NewHeaderRules(c.Headers)
+	for _, t := range c.Transforms {
+		if rule, err := t.rule(); err == nil {
+			policy.Transforms = append(policy.Transforms, rule)
+		}
+	}
+
+	return policy
+}
+
+// DrainConfig returns the shutdown settings for RunServer.
+func (c *Config) DrainConfig() DrainConfig {
+	return DrainConfig{
+		ReadinessGrace: time.Duration(c.Shutdown.ReadinessGrace),
+		Timeout:        time.Duration(c.Shutdown.Timeout),
+	}
+}
+
+// ConfigOverrides are settings given by flags or environment variables. They
+// take precedence over the configuration file.
+type ConfigOverrides struct {
+	Path          string
+	Listen        string
+	LogLevel      string
+	UpstreamProxy string
+}
+
+// ParseConfigOverrides parses the command-line flags in args. Each flag
+// defaults to its PROXY_* environment variable, read with getenv.
+func ParseConfigOverrides(args []string, getenv func(string) string) (ConfigOverrides, error) {
+	var o ConfigOverrides
+
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	fs.StringVar(&o.Path, "config", getenv("PROXY_CONFIG"), "path to a JSON configuration file (env PROXY_CONFIG)")
+	fs.StringVar(&o.Listen, "listen", getenv("PROXY_LISTEN"), "listen address, replaces configured listeners (env PROXY_LISTEN)")
+	fs.StringVar(&o.LogLevel, "log-level", getenv("PROXY_LOG_LEVEL"), "log level: debug, info, warn or error (env PROXY_LOG_LEVEL)")
+	fs.StringVar(&o.UpstreamProxy, "upstream-proxy", getenv("PROXY_UPSTREAM_PROXY"), "upstream proxy URL for all hosts: http, https or socks5 (env PROXY_UPSTREAM_PROXY)")
+
+	return o, fs.Parse(args)
+}
+
+// LoadConfig reads the configuration file, if any, over DefaultConfig, applies
+// the overrides and validates the result.
+func LoadConfig(o ConfigOverrides) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if o.Path != "" {
+		data, err := os.ReadFile(o.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", o.Path, err)
+		}
+	}
+
+	if o.Listen != "" {
+		cfg.Listeners = []ListenerConfig{{Address: o.Listen}}
+	}
+	if o.LogLevel != "" {
+		cfg.Logging.Level = o.LogLevel
+	}
+	if o.UpstreamProxy != "" {
+		cfg.Upstream.Proxy = o.UpstreamProxy
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return cfg, nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// NewLogger returns a logger writing to stderr in the configured format. Its
+// level is read from level, which is set to the configured level, so it can
+// be changed on reload.
+func NewLogger(cfg LoggingConfig, level *slog.LevelVar) *slog.Logger {
+	l, _ := parseLogLevel(cfg.Level)
+	level.Set(l)
+
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// WatchConfig calls reload on SIGHUP and when the modification time of path
+// changes, checked every interval, until ctx is done.
+func WatchConfig(ctx context.Context, path string, interval time.Duration, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	last := modTime()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last = modTime()
+			reload()
+		case <-ticker.C:
+			if current := modTime(); !current.Equal(last) {
+				last = current
+				reload()
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"listeners": [{"address": ":9090"}],
+		"timeouts": {
+			"default": {"dial": "1s"},
+			"overrides": [{"host": "reports.example.com", "total": "5m"}]
+		},
+		"hosts": {"deny": ["*.internal"]},
+		"logging": {"level": "debug", "format": "json"}
+	}`)
+
+	t.Run("file values over defaults", func(t *testing.T) {
+		cfg, err := LoadConfig(ConfigOverrides{Path: path})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if cfg.Listeners[0].Address != ":9090" {
+			t.Errorf("expected listener :9090, got %q", cfg.Listeners[0].Address)
+		}
+
+		policy := cfg.Policy()
+		if got := policy.Timeouts.forHost("reports.example.com"); got.Total != 5*time.Minute || got.Dial != time.Second {
+			t.Errorf("unexpected timeouts for reports host: %+v", got)
+		}
+		if got := policy.Timeouts.forHost("example.com"); got.ResponseHeader != 10*time.Second {
+			t.Errorf("expected default response header timeout to be kept, got %+v", got)
+		}
+		if policy.Hosts.check("db.internal") == nil {
+			t.Error("expected denied host to fail policy check")
+		}
+	})
+
+	t.Run("flags and environment over file", func(t *testing.T) {
+		env := map[string]string{
+			"PROXY_CONFIG":    path,
+			"PROXY_LISTEN":    ":7070",
+			"PROXY_LOG_LEVEL": "warn",
+		}
+		overrides, err := ParseConfigOverrides([]string{"-listen", ":6060"}, func(key string) string {
+			return env[key]
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		cfg, err := LoadConfig(overrides)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if cfg.Listeners[0].Address != ":6060" {
+			t.Errorf("expected flag listener :6060, got %q", cfg.Listeners[0].Address)
+		}
+		if cfg.Logging.Level != "warn" {
+			t.Errorf("expected env log level warn, got %q", cfg.Logging.Level)
+		}
+	})
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	testCases := []struct {
+		name        string
+		content     string
+		expectError string
+	}{
+		{
+			name:        "unknown field",
+			content:     `{"listenrs": []}`,
+			expectError: "unknown field",
+		},
+		{
+			name:        "bad duration",
+			content:     `{"timeouts": {"default": {"dial": "soon"}}}`,
+			expectError: "invalid duration",
+		},
+		{
+			name:        "bad listener",
+			content:     `{"listeners": [{"address": "8080"}]}`,
+			expectError: "listeners[0].address",
+		},
+		{
+			name:        "bad host pattern",
+			content:     `{"hosts": {"allow": ["https://example.com"]}}`,
+			expectError: "must be a bare host name",
+		},
+		{
+			name:        "bad upstream proxy",
+			content:     `{"upstream": {"proxy": "ftp://proxy.corp"}}`,
+			expectError: "unsupported upstream proxy scheme",
+		},
+		{
+			name:        "upstream rule without proxies",
+			content:     `{"upstream": {"rules": [{"hosts": ["*.corp"]}]}}`,
+			expectError: "at least one proxy or DIRECT is required",
+		},
+		{
+			name:        "socks without users under auth",
+			content:     `{"auth": {"api_keys": {"crawler": "key"}}, "socks": {"address": ":1080"}}`,
+			expectError: "socks.users: required when auth is configured",
+		},
+		{
+			name:        "bad admin address",
+			content:     `{"admin": {"address": "9090"}}`,
+			expectError: "admin.address",
+		},
+		{
+			name:        "auth without methods",
+			content:     `{"auth": {"realm": "proxy"}}`,
+			expectError: "at least one of htpasswd, api_keys or jwt is required",
+		},
+		{
+			name:        "jwt without jwks",
+			content:     `{"auth": {"jwt": {"issuer": "https://issuer.example"}}}`,
+			expectError: "auth.jwt.jwks",
+		},
+		{
+			name:        "bad rate limit",
+			content:     `{"rate_limit": {"host_overrides": [{"host": "api.example.com", "rate": 5}]}}`,
+			expectError: "rate_limit.host_overrides[0]: rate must be positive and burst at least 1",
+		},
+		{
+			name:        "negative concurrency",
+			content:     `{"concurrency": {"host_overrides": [{"host": "api.example.com", "max_in_flight": -1}]}}`,
+			expectError: "concurrency.host_overrides[0].max_in_flight",
+		},
+		{
+			name:        "bad content type pattern",
+			content:     `{"content_types": [{"hosts": ["*"], "deny": ["exe"]}]}`,
+			expectError: "content_types[0]: content type pattern \"exe\"",
+		},
+		{
+			name:        "bad h2c host",
+			content:     `{"http2": {"upstream": {"h2c_hosts": ["http://grpc.internal"]}}}`,
+			expectError: "http2.upstream.h2c_hosts",
+		},
+		{
+			name:        "negative resume attempts",
+			content:     `{"resume": {"enabled": true, "max_attempts": -1}}`,
+			expectError: "resume.max_attempts",
+		},
+		{
+			name:        "bad header rule",
+			content:     `{"headers": [{"phase": "request", "actions": [{"op": "set", "name": "X-Id", "value": "{{.Sesion}}"}]}]}`,
+			expectError: "headers[0]: actions[0].value",
+		},
+		{
+			name:        "bad json pointer",
+			content:     `{"transforms": [{"type": "json_remove", "pointers": ["user/ssn"]}]}`,
+			expectError: "transforms[0]: JSON pointer \"user/ssn\" must start with /",
+		},
+		{
+			name:        "bad default scheme",
+			content:     `{"targets": {"default_scheme": "ftp"}}`,
+			expectError: "targets: default_scheme must be \"http\" or \"https\", got \"ftp\"",
+		},
+		{
+			name:        "politeness without user agent",
+			content:     `{"politeness": {"enabled": true}}`,
+			expectError: "politeness: user_agent is required when enabled",
+		},
+		{
+			name:        "politeness max below min delay",
+			content:     `{"politeness": {"min_delay": "2s", "max_delay": "1s"}}`,
+			expectError: "politeness: max_delay must not be less than min_delay",
+		},
+		{
+			name:        "negative batch parallelism",
+			content:     `{"batch": {"parallelism": -1}}`,
+			expectError: "batch: parallelism and max_items must not be negative",
+		},
+		{
+			name:        "short signing key",
+			content:     `{"targets": {"signing_keys": ["short"]}}`,
+			expectError: "targets: signing_keys[0]: must be at least 16 bytes",
+		},
+		{
+			name:        "require signed without keys",
+			content:     `{"targets": {"require_signed": true}}`,
+			expectError: "targets: require_signed needs at least one signing key",
+		},
+		{
+			name:        "missing error page",
+			content:     `{"errors": {"html_page": "/nonexistent/error.html"}}`,
+			expectError: "errors.html_page",
+		},
+		{
+			name:        "bad log format",
+			content:     `{"logging": {"level": "info", "format": "xml"}}`,
+			expectError: "logging.format",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadConfig(ConfigOverrides{Path: writeConfigFile(t, tc.content)})
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("expected error containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestProxyPolicyReload(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{})
+
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	policy := DefaultPolicy()
+	policy.Hosts.Deny = []string{"127.0.0.1"}
+	proxy.SetPolicy(policy)
+
+	w = newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status code %d after reload, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := writeConfigFile(t, `{}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan struct{}, 1)
+	go WatchConfig(ctx, path, 10*time.Millisecond, func() {
+		reloaded <- struct{}{}
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("failed to touch config: %v", err)
+	}
+
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("expected config change to trigger a reload")
+	}
+}
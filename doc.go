@@ -0,0 +1,4 @@
+// Package proxy implements a session-aware HTTP forward proxy served under
+// /proxy/<url>. The cmd/proxy binary wires it to configuration, listeners
+// and graceful shutdown.
+package proxy
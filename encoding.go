@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+	encodingZstd     = "zstd"
+)
+
+var supportedEncodings = []string{encodingZstd, encodingBrotli, encodingGzip}
+
+const upstreamAcceptEncoding = "zstd, br, gzip"
+
+// CompressionPolicy compresses uncompressed responses of at least MinSize
+// bytes whose media type matches ContentTypes, for clients that accept it.
+type CompressionPolicy struct {
+	Enabled      bool     `json:"enabled"`
+	MinSize      int      `json:"min_size,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+}
+
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+func (c CompressionPolicy) compressible(contentType string, size int) bool {
+	if !c.Enabled || size < c.MinSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	patterns := c.ContentTypes
+	if len(patterns) == 0 {
+		patterns = defaultCompressibleTypes
+	}
+
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return matchMediaType(pattern, mediaType)
+	})
+}
+
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[name] = q
+	}
+
+	return accepted
+}
+
+func acceptsEncoding(accepted map[string]float64, encoding string) bool {
+	if q, ok := accepted[encoding]; ok {
+		return q > 0
+	}
+	if q, ok := accepted["*"]; ok {
+		return q > 0
+	}
+	return false
+}
+
+func preferredEncoding(accepted map[string]float64) string {
+	best, bestQ := encodingIdentity, 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewReader(r)
+	case encodingBrotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case encodingZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingBrotli:
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case encodingZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func planEncoding(r *http.Request, resp *http.Response, size int, policy *Policy) (decode, encode string) {
+	if size == 0 || resp.StatusCode == http.StatusPartialContent {
+		return "", ""
+	}
+
+	upstream := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if upstream == encodingIdentity {
+		upstream = ""
+	}
+	if upstream != "" && !slices.Contains(supportedEncodings, upstream) {
+		return "", ""
+	}
+
+	accepted := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+	if upstream != "" && acceptsEncoding(accepted, upstream) {
+		return "", ""
+	}
+
+	if upstream == "" && !policy.Compression.compressible(resp.Header.Get("Content-Type"), size) {
+		return "", ""
+	}
+
+	if !slices.ContainsFunc(resp.Header.Values("Vary"), func(v string) bool {
+		return strings.Contains(strings.ToLower(v), "accept-encoding")
+	}) {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+
+	target := preferredEncoding(accepted)
+	if target == encodingIdentity {
+		target = ""
+	}
+	return upstream, target
+}
+
+func negotiateEncodingStream(r *http.Request, resp *http.Response, body io.ReadCloser, size int, policy *Policy) (io.ReadCloser, string, error) {
+	decode, encode := planEncoding(r, resp, size, policy)
+	if decode == "" && encode == "" {
+		return body, "", nil
+	}
+
+	if decode != "" {
+		decoder, err := newDecoder(decode, body)
+		if err != nil {
+			return nil, "", err
+		}
+		body = newLimitedBody(decoder, "response", policy.Limits.decodedLimit())
+		resp.Header.Del("Content-Encoding")
+	}
+
+	if encode != "" {
+		resp.Header.Set("Content-Encoding", encode)
+	}
+
+	weakenETag(resp)
+	resp.Header.Del("Content-Length")
+
+	return body, encode, nil
+}
+
+func decodeStreamForClient(r *http.Request, resp *http.Response, limit int64) error {
+	if resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == encodingIdentity || !slices.Contains(supportedEncodings, encoding) {
+		return nil
+	}
+	if acceptsEncoding(parseAcceptEncoding(r.Header.Get("Accept-Encoding")), encoding) {
+		return nil
+	}
+
+	decoder, err := newDecoder(encoding, resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = &pipelineBody{Reader: newLimitedBody(decoder, "response", limit), closers: []io.Closer{resp.Body, decoder}}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	weakenETag(resp)
+	return nil
+}
+
+func upstreamAcceptEncodingFor(r *http.Request) string {
+	if r.Header.Get("Range") != "" {
+		return r.Header.Get("Accept-Encoding")
+	}
+	return upstreamAcceptEncoding
+}
+
+func weakenETag(resp *http.Response) {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
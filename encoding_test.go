@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyContentEncoding(t *testing.T) {
+	original := []byte(strings.Repeat("<p>hello compressed world</p>", 100))
+
+	var upstreamAccept string
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamAccept = r.Header.Get("Accept-Encoding")
+
+			encoding := r.URL.Query().Get("encoding")
+			body := original
+			if encoding != "" {
+				body, _ = encodeBody(encoding, original)
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(body)
+		}),
+	)
+	defer service.Close()
+
+	testCases := []struct {
+		name           string
+		upstream       string
+		accept         string
+		compression    CompressionPolicy
+		expectEncoding string
+	}{
+		{
+			name:           "passes through accepted encoding",
+			upstream:       encodingGzip,
+			accept:         "gzip, deflate",
+			expectEncoding: encodingGzip,
+		},
+		{
+			name:           "re-encodes unaccepted encoding",
+			upstream:       encodingBrotli,
+			accept:         "gzip",
+			expectEncoding: encodingGzip,
+		},
+		{
+			name:           "decodes for clients without encodings",
+			upstream:       encodingZstd,
+			expectEncoding: "",
+		},
+		{
+			name:           "honours q values",
+			upstream:       encodingGzip,
+			accept:         "gzip;q=0, br;q=0.5, zstd;q=0.9",
+			expectEncoding: encodingZstd,
+		},
+		{
+			name:           "compresses uncompressed responses",
+			accept:         "br",
+			compression:    CompressionPolicy{Enabled: true},
+			expectEncoding: encodingBrotli,
+		},
+		{
+			name:           "skips small responses",
+			accept:         "gzip",
+			compression:    CompressionPolicy{Enabled: true, MinSize: 1 << 20},
+			expectEncoding: "",
+		},
+		{
+			name:           "skips other content types",
+			accept:         "gzip",
+			compression:    CompressionPolicy{Enabled: true, ContentTypes: []string{"application/json"}},
+			expectEncoding: "",
+		},
+		{
+			name:           "leaves uncompressed responses by default",
+			accept:         "gzip",
+			expectEncoding: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.Compression = tc.compression
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+"?encoding="+tc.upstream, nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept-Encoding", tc.accept)
+			}
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.buffer.String())
+			}
+			if upstreamAccept != upstreamAcceptEncoding {
+				t.Errorf("expected upstream Accept-Encoding %q, got %q", upstreamAcceptEncoding, upstreamAccept)
+			}
+
+			encoding := w.Header().Get("Content-Encoding")
+			if encoding != tc.expectEncoding {
+				t.Fatalf("expected Content-Encoding %q, got %q", tc.expectEncoding, encoding)
+			}
+
+			body := w.buffer.Bytes()
+			if encoding != "" {
+				decoder, err := newDecoder(encoding, bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("failed to create %s decoder: %v", encoding, err)
+				}
+				decoded, err := io.ReadAll(decoder)
+				if err != nil {
+					t.Fatalf("failed to decode %s body: %v", encoding, err)
+				}
+				body = decoded
+			}
+			if !bytes.Equal(body, original) {
+				t.Errorf("expected original body after decoding, got %d bytes", len(body))
+			}
+
+			if encoding != tc.upstream && w.Header().Get("ETag") != `W/"v1"` {
+				t.Errorf("expected weakened ETag for transformed body, got %q", w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestProxyContentEncodingLimit(t *testing.T) {
+	bomb, _ := encodeBody(encodingGzip, make([]byte, 1<<20))
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", encodingGzip)
+			w.Write(bomb)
+		}),
+	)
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.Limits.MaxResponseBody = 64 << 10
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+	if w.Code != http.StatusBadGateway || w.Header().Get("X-Proxy-Error") != string(CodeResponseTooLarge) {
+		t.Errorf("expected decoded size to be limited, got %d %s", w.Code, w.Header().Get("X-Proxy-Error"))
+	}
+}
+
+func TestProxyContentEncodingDefaultLimit(t *testing.T) {
+	bomb, _ := encodeBody(encodingGzip, make([]byte, defaultMaxDecodedBody+1))
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", encodingGzip)
+			w.Write(bomb)
+		}),
+	)
+	defer service.Close()
+
+	front := httptest.NewServer(NewProxy(&http.Client{}))
+	defer front.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/proxy/"+service.URL, nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err == nil {
+		t.Error("expected the response to be aborted at the default decoded size limit")
+	}
+	if n > defaultMaxDecodedBody {
+		t.Errorf("expected at most %d decoded bytes, got %d", defaultMaxDecodedBody, n)
+	}
+}
+
+func TestProxyStreamedContentEncoding(t *testing.T) {
+	original := []byte(strings.Repeat("streamed body ", 100))
+
+	var upstreamAccept string
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamAccept = r.Header.Get("Accept-Encoding")
+
+			if r.URL.Path == "/trailers" {
+				body, _ := encodeBody(encodingZstd, original)
+				w.Header().Set("Content-Encoding", encodingZstd)
+				w.Header().Set("Trailer", "X-Checksum")
+				w.Write(body)
+				w.Header().Set("X-Checksum", "ok")
+				return
+			}
+			http.ServeContent(w, r, "data.txt", time.Time{}, bytes.NewReader(original))
+		}),
+	)
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{})
+
+	testCases := []struct {
+		name           string
+		path           string
+		headers        map[string]string
+		upstreamAccept string
+		status         int
+		body           []byte
+	}{
+		{
+			name:           "range keeps the client's encodings",
+			path:           "/data",
+			headers:        map[string]string{"Range": "bytes=10-19", "Accept-Encoding": "gzip"},
+			upstreamAccept: "gzip",
+			status:         http.StatusPartialContent,
+			body:           original[10:20],
+		},
+		{
+			name:    "range without encodings",
+			path:    "/data",
+			headers: map[string]string{"Range": "bytes=0-4"},
+			status:  http.StatusPartialContent,
+			body:    original[:5],
+		},
+		{
+			name:           "streamed response decoded on the fly",
+			path:           "/trailers",
+			headers:        map[string]string{"Accept-Encoding": "gzip"},
+			upstreamAccept: upstreamAcceptEncoding,
+			status:         http.StatusOK,
+			body:           original,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+tc.path, nil)
+			for key, value := range tc.headers {
+				r.Header.Set(key, value)
+			}
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.buffer.String())
+			}
+			if upstreamAccept != tc.upstreamAccept {
+				t.Errorf("expected upstream Accept-Encoding %q, got %q", tc.upstreamAccept, upstreamAccept)
+			}
+			if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+				t.Errorf("expected an unencoded body, got %q", encoding)
+			}
+			if !bytes.Equal(w.buffer.Bytes(), tc.body) {
+				t.Errorf("expected %q, got %q", tc.body, w.buffer.Bytes())
+			}
+		})
+	}
+}
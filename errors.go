@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrorCode identifies a proxy error in the code field and the X-Proxy-Error
+// header of error responses.
+type ErrorCode string
+
+// Error codes, listed with their status codes in the README.
+const (
+	CodeInvalidTarget         ErrorCode = "invalid-target"
+	CodeInvalidSignature      ErrorCode = "invalid-signature"
+	CodeInvalidBatch          ErrorCode = "invalid-batch"
+	CodeDraining              ErrorCode = "draining"
+	CodeUnauthorized          ErrorCode = "unauthorized"
+	CodePolicyDenied          ErrorCode = "policy-denied"
+	CodeRobotsDisallowed      ErrorCode = "robots-disallowed"
+	CodeRateLimited           ErrorCode = "rate-limited"
+	CodeCircuitOpen           ErrorCode = "circuit-open"
+	CodeQueueTimeout          ErrorCode = "queue-timeout"
+	CodeRequestTooLarge       ErrorCode = "request-too-large"
+	CodeResponseTooLarge      ErrorCode = "response-too-large"
+	CodeDNSFailure            ErrorCode = "dns-failure"
+	CodeConnectionRefused     ErrorCode = "connection-refused"
+	CodeTLSError              ErrorCode = "tls-error"
+	CodeTooManyRedirects      ErrorCode = "too-many-redirects"
+	CodeBodyReadFailed        ErrorCode = "body-read-failed"
+	CodeTransformFailed       ErrorCode = "transform-failed"
+	CodeUpstreamProxyFailed   ErrorCode = "upstream-proxy-failed"
+	CodeDialTimeout           ErrorCode = "dial-timeout"
+	CodeTLSHandshakeTimeout   ErrorCode = "tls-handshake-timeout"
+	CodeResponseHeaderTimeout ErrorCode = "response-header-timeout"
+	CodeIdleBodyTimeout       ErrorCode = "idle-body-timeout"
+	CodeTotalTimeout          ErrorCode = "total-timeout"
+	CodeDeadlineExceeded      ErrorCode = "deadline-exceeded"
+	CodeUpstreamError         ErrorCode = "upstream-error"
+	CodeInternalError         ErrorCode = "internal-error"
+)
+
+var errorTitles = map[ErrorCode]string{
+	CodeInvalidTarget:         "Invalid target URL",
+	CodeInvalidSignature:      "Invalid signed link",
+	CodeInvalidBatch:          "Invalid batch request",
+	CodeDraining:              "Proxy is draining",
+	CodeUnauthorized:          "Authentication required",
+	CodePolicyDenied:          "Denied by policy",
+	CodeRobotsDisallowed:      "Disallowed by robots.txt",
+	CodeRateLimited:           "Rate limit exceeded",
+	CodeCircuitOpen:           "Upstream circuit open",
+	CodeQueueTimeout:          "Upstream queue timeout",
+	CodeRequestTooLarge:       "Request body too large",
+	CodeResponseTooLarge:      "Response body too large",
+	CodeDNSFailure:            "Upstream host not found",
+	CodeConnectionRefused:     "Upstream connection refused",
+	CodeTLSError:              "Upstream TLS error",
+	CodeTooManyRedirects:      "Too many redirects",
+	CodeBodyReadFailed:        "Upstream body read failed",
+	CodeTransformFailed:       "Response transform failed",
+	CodeUpstreamProxyFailed:   "Upstream proxy failed",
+	CodeDialTimeout:           "Upstream connect timeout",
+	CodeTLSHandshakeTimeout:   "Upstream TLS handshake timeout",
+	CodeResponseHeaderTimeout: "Upstream response header timeout",
+	CodeIdleBodyTimeout:       "Upstream body idle timeout",
+	CodeTotalTimeout:          "Upstream request timeout",
+	CodeDeadlineExceeded:      "Client deadline exceeded",
+	CodeUpstreamError:         "Upstream request failed",
+	CodeInternalError:         "Internal proxy error",
+}
+
+// Problem is an RFC 9457 problem detail. Every error the proxy returns is
+// classified into one.
+type Problem struct {
+	Type       string        `json:"type"`
+	Title      string        `json:"title"`
+	Status     int           `json:"status"`
+	Detail     string        `json:"detail,omitempty"`
+	Code       ErrorCode     `json:"code"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func newProblem(status int, code ErrorCode, detail string) *Problem {
+	title, ok := errorTitles[code]
+	if !ok {
+		title = "Proxy error"
+	}
+
+	return &Problem{
+		Type:   "urn:proxy:error:" + string(code),
+		Title:  title,
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Title, p.Detail)
+}
+
+// TooManyRedirectsError is returned when an upstream redirects more than
+// Limit times.
+type TooManyRedirectsError struct {
+	Limit int
+}
+
+func (e *TooManyRedirectsError) Error() string {
+	return fmt.Sprintf("stopped after %d redirects", e.Limit)
+}
+
+const maxRedirects = 10
+
+func checkRedirectLimit(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return &TooManyRedirectsError{Limit: maxRedirects}
+	}
+	return nil
+}
+
+// BodyReadError wraps a failure while reading or decoding an upstream body.
+type BodyReadError struct {
+	Err error
+}
+
+func (e *BodyReadError) Error() string {
+	return fmt.Sprintf("reading upstream body: %v", e.Err)
+}
+
+func (e *BodyReadError) Unwrap() error {
+	return e.Err
+}
+
+func classifyError(err error) *Problem {
+	var problem *Problem
+	if errors.As(err, &problem) {
+		return problem
+	}
+
+	var openErr *BreakerOpenError
+	if errors.As(err, &openErr) {
+		problem := newProblem(http.StatusServiceUnavailable, CodeCircuitOpen, openErr.Error())
+		problem.RetryAfter = openErr.RetryAfter
+		return problem
+	}
+
+	var queueErr *QueueTimeoutError
+	if errors.As(err, &queueErr) {
+		return newProblem(http.StatusServiceUnavailable, CodeQueueTimeout, queueErr.Error())
+	}
+
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return newProblem(http.StatusForbidden, CodePolicyDenied, policyErr.Error())
+	}
+
+	var robotsErr *RobotsError
+	if errors.As(err, &robotsErr) {
+		return newProblem(http.StatusForbidden, CodeRobotsDisallowed, robotsErr.Error())
+	}
+
+	var limitErr *RateLimitError
+	if errors.As(err, &limitErr) {
+		problem := newProblem(http.StatusTooManyRequests, CodeRateLimited, limitErr.Error())
+		problem.RetryAfter = limitErr.RetryAfter
+		return problem
+	}
+
+	var sizeErr *BodyTooLargeError
+	if errors.As(err, &sizeErr) {
+		if sizeErr.Direction == "request" {
+			return newProblem(http.StatusRequestEntityTooLarge, CodeRequestTooLarge, sizeErr.Error())
+		}
+		return newProblem(http.StatusBadGateway, CodeResponseTooLarge, sizeErr.Error())
+	}
+
+	var deadlineErr *DeadlineError
+	if errors.As(err, &deadlineErr) {
+		return newProblem(http.StatusGatewayTimeout, CodeDeadlineExceeded, deadlineErr.Error())
+	}
+
+	if phase, ok := timeoutPhase(err); ok {
+		var phaseErr *PhaseTimeoutError
+		detail := "upstream " + string(phase) + " timeout"
+		if errors.As(err, &phaseErr) {
+			detail = phaseErr.Error()
+		}
+		return newProblem(http.StatusGatewayTimeout, ErrorCode(string(phase)+"-timeout"), detail)
+	}
+
+	var redirectErr *TooManyRedirectsError
+	if errors.As(err, &redirectErr) {
+		return newProblem(http.StatusBadGateway, CodeTooManyRedirects, redirectErr.Error())
+	}
+
+	var dialErr *UpstreamDialError
+	if errors.As(err, &dialErr) {
+		return newProblem(http.StatusBadGateway, CodeUpstreamProxyFailed, "no upstream proxy could reach "+hostOnly(dialErr.Addr))
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return newProblem(http.StatusBadGateway, CodeDNSFailure, "could not resolve "+dnsErr.Name)
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return newProblem(http.StatusBadGateway, CodeConnectionRefused, "the upstream host refused the connection")
+	}
+
+	if isTLSError(err) {
+		return newProblem(http.StatusBadGateway, CodeTLSError, "the TLS handshake with the upstream host failed")
+	}
+
+	var transformErr *TransformError
+	if errors.As(err, &transformErr) {
+		return newProblem(http.StatusBadGateway, CodeTransformFailed, "the upstream response could not be transformed")
+	}
+
+	var readErr *BodyReadError
+	if errors.As(err, &readErr) {
+		return newProblem(http.StatusBadGateway, CodeBodyReadFailed, "the upstream response body could not be read")
+	}
+
+	return newProblem(http.StatusBadGateway, CodeUpstreamError, "the upstream request failed")
+}
+
+func isTLSError(err error) bool {
+	var (
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// StatusForUpstreamError returns the status code the proxy answers with for
+// err.
+func StatusForUpstreamError(err error) int {
+	return classifyError(err).Status
+}
+
+func (p *Proxy) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var limitErr *RateLimitError
+	if errors.As(err, &limitErr) && limitErr.decision.limit.Burst > 0 {
+		setRateLimitHeaders(w, limitErr.decision)
+	}
+
+	problem := classifyError(err)
+	captureProblem(r, problem)
+	if p.errorHandler != nil {
+		p.errorHandler(w, r, problem, err)
+		return
+	}
+	writeProblem(w, r, problem, p.Policy().ErrorPage)
+}
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+<p><small>{{.Code}}</small></p>
+</body>
+</html>
+`
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(defaultErrorPage))
+
+func writeProblem(w http.ResponseWriter, r *http.Request, problem *Problem, page *template.Template) {
+	if problem.RetryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(problem.RetryAfter))
+	}
+	w.Header().Set("X-Proxy-Error", string(problem.Code))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if mode := grpcRequestMode(r); mode != grpcNone {
+		writeGRPCProblem(w, mode, r.Header.Get("Content-Type"), problem)
+		return
+	}
+
+	if prefersHTML(r) {
+		if page == nil {
+			page = defaultErrorTemplate
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(problem.Status)
+		page.Execute(w, problem)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") && !strings.Contains(accept, "json")
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
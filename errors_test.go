@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name   string
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{
+			name:   "dns failure",
+			err:    &url.Error{Op: "Get", URL: "http://nope.invalid", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Name: "nope.invalid", Err: "no such host"}}},
+			status: http.StatusBadGateway,
+			code:   CodeDNSFailure,
+		},
+		{
+			name:   "connection refused",
+			err:    &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			status: http.StatusBadGateway,
+			code:   CodeConnectionRefused,
+		},
+		{
+			name:   "tls error",
+			err:    &url.Error{Op: "Get", URL: "https://example.com", Err: x509.UnknownAuthorityError{}},
+			status: http.StatusBadGateway,
+			code:   CodeTLSError,
+		},
+		{
+			name:   "phase timeout",
+			err:    &PhaseTimeoutError{Phase: PhaseDial, After: time.Second},
+			status: http.StatusGatewayTimeout,
+			code:   CodeDialTimeout,
+		},
+		{
+			name:   "network timeout",
+			err:    &url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}},
+			status: http.StatusGatewayTimeout,
+			code:   CodeTotalTimeout,
+		},
+		{
+			name:   "client deadline",
+			err:    &url.Error{Op: "Post", URL: "http://grpc.internal", Err: &DeadlineError{Timeout: time.Second}},
+			status: http.StatusGatewayTimeout,
+			code:   CodeDeadlineExceeded,
+		},
+		{
+			name:   "too many redirects",
+			err:    &url.Error{Op: "Get", URL: "http://example.com", Err: &TooManyRedirectsError{Limit: 10}},
+			status: http.StatusBadGateway,
+			code:   CodeTooManyRedirects,
+		},
+		{
+			name:   "policy denial",
+			err:    &PolicyError{Host: "example.com", Reason: "host is denied by policy"},
+			status: http.StatusForbidden,
+			code:   CodePolicyDenied,
+		},
+		{
+			name:   "body read failure",
+			err:    &BodyReadError{Err: io.ErrUnexpectedEOF},
+			status: http.StatusBadGateway,
+			code:   CodeBodyReadFailed,
+		},
+		{
+			name:   "transform failure while reading",
+			err:    &BodyReadError{Err: &TransformError{Err: io.ErrUnexpectedEOF}},
+			status: http.StatusBadGateway,
+			code:   CodeTransformFailed,
+		},
+		{
+			name:   "idle body timeout while reading",
+			err:    &BodyReadError{Err: &PhaseTimeoutError{Phase: PhaseIdleBody, After: time.Second}},
+			status: http.StatusGatewayTimeout,
+			code:   CodeIdleBodyTimeout,
+		},
+		{
+			name:   "response too large while reading",
+			err:    &BodyReadError{Err: &BodyTooLargeError{Direction: "response", Limit: 10}},
+			status: http.StatusBadGateway,
+			code:   CodeResponseTooLarge,
+		},
+		{
+			name:   "unknown",
+			err:    io.ErrClosedPipe,
+			status: http.StatusBadGateway,
+			code:   CodeUpstreamError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			problem := classifyError(tc.err)
+
+			if problem.Status != tc.status || problem.Code != tc.code {
+				t.Errorf("expected %d %s, got %d %s", tc.status, tc.code, problem.Status, problem.Code)
+			}
+			if problem.Title != errorTitles[tc.code] || problem.Type != "urn:proxy:error:"+string(tc.code) {
+				t.Errorf("expected title and type for %s, got %+v", tc.code, problem)
+			}
+		})
+	}
+
+	if title := newProblem(http.StatusBadGateway, "unmapped", "").Title; title != "Proxy error" {
+		t.Errorf("expected a neutral title for unmapped codes, got %q", title)
+	}
+}
+
+func TestProxyProblemResponses(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	tlsService := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsService.Close()
+
+	var loop *httptest.Server
+	loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loop.URL+r.URL.Path+"x", http.StatusFound)
+	}))
+	defer loop.Close()
+
+	testCases := []struct {
+		name   string
+		path   string
+		status int
+		code   ErrorCode
+	}{
+		{"connection refused", "/proxy/" + refused.URL, http.StatusBadGateway, CodeConnectionRefused},
+		{"tls error", "/proxy/" + tlsService.URL, http.StatusBadGateway, CodeTLSError},
+		{"too many redirects", "/proxy/" + loop.URL, http.StatusBadGateway, CodeTooManyRedirects},
+		{"invalid target", "/proxy/%zz", http.StatusBadRequest, CodeInvalidTarget},
+		{"missing proxy prefix", "/elsewhere", http.StatusBadRequest, CodeInvalidTarget},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := NewProxy(&http.Client{})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.URL.Path = tc.path
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.buffer.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("expected problem+json, got %q", ct)
+			}
+
+			var problem Problem
+			if err := json.Unmarshal(w.buffer.Bytes(), &problem); err != nil {
+				t.Fatalf("failed to decode problem: %v", err)
+			}
+			if problem.Code != tc.code || problem.Status != tc.status {
+				t.Errorf("expected %d %s, got %+v", tc.status, tc.code, problem)
+			}
+			if strings.Contains(w.buffer.String(), "127.0.0.1") {
+				t.Errorf("expected dial addresses not to leak, got %s", w.buffer.String())
+			}
+		})
+	}
+}
+
+func TestProxyHTMLErrorPage(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	testCases := []struct {
+		name   string
+		page   *template.Template
+		expect string
+	}{
+		{
+			name:   "default page",
+			expect: "<h1>Upstream connection refused</h1>",
+		},
+		{
+			name:   "custom page",
+			page:   template.Must(template.New("error").Parse(`<p class="oops">{{.Code}}: {{.Detail}}</p>`)),
+			expect: `<p class="oops">connection-refused: the upstream host refused the connection</p>`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.ErrorPage = tc.page
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+refused.URL, nil)
+			r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("expected html error page, got %q", ct)
+			}
+			if !strings.Contains(w.buffer.String(), tc.expect) {
+				t.Errorf("expected page to contain %q, got %s", tc.expect, w.buffer.String())
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareProblem(t *testing.T) {
+	handler := NewAuthMiddleware("proxy", NewAPIKeyAuthenticator(map[string]string{"k": "ci"})).Handler(http.NotFoundHandler())
+
+	r := httptest.NewRequest(http.MethodGet, "/proxy/http://example.com", nil)
+	r.Header.Set("X-API-Key", "wrong")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var problem Problem
+	if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if problem.Code != CodeUnauthorized || problem.Status != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized problem, got %s", fmt.Sprint(problem))
+	}
+}
@@ -1,5 +1,13 @@
-module proxy
+module github.com/abdigaliarsen/proxy
 
 go 1.25.5
 
-require github.com/go-chi/chi/v5 v5.2.5
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/go-chi/chi/v5 v5.2.5
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/crypto v0.55.0
+	golang.org/x/net v0.58.0
+)
+
+require golang.org/x/text v0.41.0 // indirect
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GRPCPolicy enables translating gRPC-Web requests from browsers into gRPC.
+type GRPCPolicy struct {
+	Web bool `json:"web"`
+}
+
+type grpcMode int
+
+const (
+	grpcNone grpcMode = iota
+	grpcNative
+	grpcWeb
+	grpcWebText
+)
+
+func grpcRequestMode(r *http.Request) grpcMode {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	base, _, _ := strings.Cut(mediaType, "+")
+
+	switch base {
+	case "application/grpc":
+		return grpcNative
+	case "application/grpc-web":
+		return grpcWeb
+	case "application/grpc-web-text":
+		return grpcWebText
+	default:
+		return grpcNone
+	}
+}
+
+func grpcContentType(mode grpcMode, contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	_, codec, _ := strings.Cut(mediaType, "+")
+
+	base := "application/grpc"
+	switch mode {
+	case grpcWeb:
+		base = "application/grpc-web"
+	case grpcWebText:
+		base = "application/grpc-web-text"
+	}
+
+	if codec == "" {
+		return base
+	}
+	return base + "+" + codec
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+// DeadlineError is returned when the deadline from a grpc-timeout header
+// passes before the upstream answers.
+type DeadlineError struct {
+	Timeout time.Duration
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("client deadline of %v exceeded", e.Timeout)
+}
+
+func deadlineErr(ctx context.Context, err error) error {
+	var deadlineErr *DeadlineError
+	if errors.As(context.Cause(ctx), &deadlineErr) {
+		return deadlineErr
+	}
+	return err
+}
+
+func translateGRPCWebRequest(req *http.Request, mode grpcMode) {
+	req.Header.Set("Content-Type", grpcContentType(grpcNative, req.Header.Get("Content-Type")))
+	req.Header.Set("Te", "trailers")
+	req.Header.Del("X-Grpc-Web")
+
+	if mode == grpcWebText && req.Body != nil && req.Body != http.NoBody {
+		body := req.Body
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{base64.NewDecoder(base64.StdEncoding, body), body}
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		req.GetBody = nil
+	}
+}
+
+func streamGRPCWebResponse(w http.ResponseWriter, resp *http.Response, mode grpcMode) {
+	w.Header().Set("Content-Type", grpcContentType(mode, resp.Header.Get("Content-Type")))
+	w.Header().Del("Content-Length")
+	w.Header().Del("Trailer")
+	w.WriteHeader(resp.StatusCode)
+
+	var out io.Writer = w
+	var encoder io.WriteCloser
+	if mode == grpcWebText {
+		encoder = base64.NewEncoder(base64.StdEncoding, w)
+		out = encoder
+	}
+
+	copyBody(w, out, resp.Body)
+
+	if len(resp.Trailer) > 0 {
+		out.Write(grpcWebTrailerFrame(resp.Trailer))
+	}
+	if encoder != nil {
+		encoder.Close()
+	}
+}
+
+func grpcWebTrailerFrame(trailer http.Header) []byte {
+	keys := make([]string, 0, len(trailer))
+	for key := range trailer {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var block bytes.Buffer
+	for _, key := range keys {
+		for _, value := range trailer[key] {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(key), value)
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	return append(frame, block.Bytes()...)
+}
+
+const (
+	grpcCodeUnknown           = 2
+	grpcCodeInvalidArgument   = 3
+	grpcCodeDeadlineExceeded  = 4
+	grpcCodePermissionDenied  = 7
+	grpcCodeResourceExhausted = 8
+	grpcCodeUnavailable       = 14
+	grpcCodeUnauthenticated   = 16
+)
+
+func grpcStatusForProblem(problem *Problem) int {
+	switch problem.Status {
+	case http.StatusBadRequest:
+		return grpcCodeInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcCodeUnauthenticated
+	case http.StatusForbidden:
+		return grpcCodePermissionDenied
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcCodeResourceExhausted
+	case http.StatusGatewayTimeout:
+		return grpcCodeDeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcCodeUnavailable
+	default:
+		return grpcCodeUnknown
+	}
+}
+
+func writeGRPCProblem(w http.ResponseWriter, mode grpcMode, contentType string, problem *Problem) {
+	w.Header().Set("Content-Type", grpcContentType(mode, contentType))
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusForProblem(problem)))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(problem.Detail))
+	w.WriteHeader(http.StatusOK)
+}
+
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
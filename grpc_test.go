@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func grpcEchoService(t *testing.T) string {
+	t.Helper()
+
+	return serveHTTP2(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("X-Upstream-Te", r.Header.Get("Te"))
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}), HTTP2Config{H2C: true})
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	testCases := []struct {
+		value   string
+		timeout time.Duration
+		ok      bool
+	}{
+		{"100m", 100 * time.Millisecond, true},
+		{"5S", 5 * time.Second, true},
+		{"1H", time.Hour, true},
+		{"250u", 250 * time.Microsecond, true},
+		{"12345678n", 12345678 * time.Nanosecond, true},
+		{"123456789n", 0, false},
+		{"10", 0, false},
+		{"m", 0, false},
+		{"-5S", 0, false},
+		{"5s", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			timeout, ok := parseGRPCTimeout(tc.value)
+			if ok != tc.ok || timeout != tc.timeout {
+				t.Errorf("expected %v %v, got %v %v", tc.timeout, tc.ok, timeout, ok)
+			}
+		})
+	}
+}
+
+func TestProxyGRPC(t *testing.T) {
+	upstream := grpcEchoService(t)
+
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	policy := DefaultPolicy()
+	policy.HTTP2 = UpstreamHTTP2{H2CHosts: []string{"127.0.0.1"}}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+	addr := serveHTTP2(t, proxy, HTTP2Config{H2C: true})
+
+	testCases := []struct {
+		name    string
+		target  string
+		timeout string
+		status  string
+		message string
+	}{
+		{"trailers forwarded", "http://" + upstream + "/echo", "", "0", "ok"},
+		{"deadline from grpc-timeout", "http://" + upstream + "/slow", "50m", "4", "client deadline of 50ms exceeded"},
+		{"unreachable upstream", refused.URL, "", "14", "the upstream host refused the connection"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/proxy/"+tc.target, bytes.NewReader(grpcFrame("ping")))
+			req.Header.Set("Content-Type", "application/grpc+proto")
+			if tc.timeout != "" {
+				req.Header.Set("Grpc-Timeout", tc.timeout)
+			}
+
+			start := time.Now()
+			resp, err := h2cClient().Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			io.ReadAll(resp.Body)
+
+			if time.Since(start) > time.Second {
+				t.Errorf("expected the call to finish quickly, took %v", time.Since(start))
+			}
+
+			status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+			if status == "" {
+				status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+			}
+			if resp.StatusCode != http.StatusOK || status != tc.status || message != tc.message {
+				t.Errorf("expected grpc-status %s %q, got %d %s %q", tc.status, tc.message, resp.StatusCode, status, message)
+			}
+		})
+	}
+}
+
+func TestProxyGRPCWeb(t *testing.T) {
+	upstream := grpcEchoService(t)
+
+	trailer := grpcWebTrailerFrame(http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}})
+	expect := append(grpcFrame("ping"), trailer...)
+
+	testCases := []struct {
+		name        string
+		contentType string
+		web         bool
+		body        []byte
+		expectType  string
+		expectBody  []byte
+	}{
+		{
+			name:        "binary",
+			contentType: "application/grpc-web+proto",
+			web:         true,
+			body:        grpcFrame("ping"),
+			expectType:  "application/grpc-web+proto",
+			expectBody:  expect,
+		},
+		{
+			name:        "text",
+			contentType: "application/grpc-web-text",
+			web:         true,
+			body:        []byte(base64.StdEncoding.EncodeToString(grpcFrame("ping"))),
+			expectType:  "application/grpc-web-text",
+			expectBody:  []byte(base64.StdEncoding.EncodeToString(expect)),
+		},
+		{
+			name:        "translation disabled",
+			contentType: "application/grpc-web+proto",
+			body:        grpcFrame("ping"),
+			expectType:  "application/grpc-web+proto",
+			expectBody:  grpcFrame("ping"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.HTTP2 = UpstreamHTTP2{H2CHosts: []string{"127.0.0.1"}}
+			policy.GRPC = GRPCPolicy{Web: tc.web}
+			service := httptest.NewServer(NewProxy(&http.Client{}, WithPolicy(policy)))
+			defer service.Close()
+
+			resp, err := http.Post(service.URL+"/proxy/http://"+upstream+"/echo", tc.contentType, bytes.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if ct := resp.Header.Get("Content-Type"); ct != tc.expectType {
+				t.Errorf("expected content type %s, got %s", tc.expectType, ct)
+			}
+			if !bytes.Equal(body, tc.expectBody) {
+				t.Errorf("expected body %q, got %q", tc.expectBody, body)
+			}
+			if tc.web && resp.Header.Get("X-Upstream-Te") != "trailers" {
+				t.Errorf("expected upstream request to carry TE: trailers")
+			}
+		})
+	}
+}
+
+func TestGRPCWebTrailerFrame(t *testing.T) {
+	frame := grpcWebTrailerFrame(http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}})
+
+	block := "grpc-message: ok\r\ngrpc-status: 0\r\n"
+	if frame[0] != 0x80 || binary.BigEndian.Uint32(frame[1:5]) != uint32(len(block)) || string(frame[5:]) != block {
+		t.Errorf("unexpected trailer frame %q", frame)
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	if got := encodeGRPCMessage("100% done\nnext"); got != "100%25 done%0Anext" {
+		t.Errorf("unexpected encoding %q", got)
+	}
+	if !strings.Contains(encodeGRPCMessage("héllo"), "%C3%A9") {
+		t.Errorf("expected non-ascii bytes to be percent-encoded")
+	}
+}
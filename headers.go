@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// HeaderPhase says whether a HeaderRule rewrites requests or responses.
+type HeaderPhase string
+
+// Header rule phases.
+const (
+	HeaderPhaseRequest  HeaderPhase = "request"
+	HeaderPhaseResponse HeaderPhase = "response"
+)
+
+// HeaderOp is what a HeaderAction does to its header.
+type HeaderOp string
+
+// Header rule operations. Replace rewrites the values matching Pattern.
+const (
+	HeaderSet     HeaderOp = "set"
+	HeaderAppend  HeaderOp = "append"
+	HeaderRemove  HeaderOp = "remove"
+	HeaderReplace HeaderOp = "replace"
+)
+
+// HeaderMatch selects the requests or responses a HeaderRule applies to. Empty
+// fields match everything. Statuses only apply to response rules.
+type HeaderMatch struct {
+	Hosts        []string `json:"hosts,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	Statuses     []int    `json:"statuses,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+}
+
+// HeaderAction changes the header Name. Value is a text/template evaluated
+// with HeaderVars.
+type HeaderAction struct {
+	Op      HeaderOp `json:"op"`
+	Name    string   `json:"name"`
+	Value   string   `json:"value,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+}
+
+// HeaderRule applies its Actions, in order, to what Match selects in Phase.
+type HeaderRule struct {
+	Phase   HeaderPhase    `json:"phase"`
+	Match   HeaderMatch    `json:"match"`
+	Actions []HeaderAction `json:"actions"`
+}
+
+// HeaderVars are the values available to HeaderAction templates.
+type HeaderVars struct {
+	SessionID string
+	ClientIP  string
+	Principal string
+	Host      string
+	Method    string
+	Path      string
+}
+
+func headerVars(r, req *http.Request, session string) HeaderVars {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	vars := HeaderVars{
+		SessionID: session,
+		ClientIP:  client,
+	}
+	if principal := PrincipalFromContext(r.Context()); principal != nil {
+		vars.Principal = principal.Name
+	}
+	return vars.forRequest(req)
+}
+
+func (v HeaderVars) forRequest(req *http.Request) HeaderVars {
+	v.Host = req.URL.Host
+	v.Method = req.Method
+	v.Path = req.URL.Path
+	return v
+}
+
+const headerEnvPrefix = "PROXY_HDR_"
+
+func headerEnv(name string) (string, error) {
+	if !strings.HasPrefix(name, headerEnvPrefix) {
+		return "", fmt.Errorf("env only reads variables starting with %s, got %q", headerEnvPrefix, name)
+	}
+	return os.Getenv(name), nil
+}
+
+var headerTemplateFuncs = template.FuncMap{
+	"env": headerEnv,
+}
+
+type compiledAction struct {
+	HeaderAction
+	value   *template.Template
+	pattern *regexp.Regexp
+}
+
+type compiledRule struct {
+	HeaderRule
+	actions []compiledAction
+}
+
+func (r HeaderRule) compile() (*compiledRule, error) {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if r.Phase != HeaderPhaseRequest && r.Phase != HeaderPhaseResponse {
+		fail("phase", "must be \"request\" or \"response\", got %q", r.Phase)
+	}
+	if r.Phase == HeaderPhaseRequest && len(r.Match.Statuses) > 0 {
+		fail("match.statuses", "only applies to response rules")
+	}
+	for _, pattern := range r.Match.Hosts {
+		if err := validHostPattern(pattern); err != nil {
+			fail("match.hosts", "%v", err)
+		}
+	}
+	for _, path := range r.Match.Paths {
+		if !strings.HasPrefix(path, "/") {
+			fail("match.paths", "path prefix %q must start with /", path)
+		}
+	}
+	for _, pattern := range r.Match.ContentTypes {
+		if err := validMediaTypePattern(pattern); err != nil {
+			fail("match.content_types", "%v", err)
+		}
+	}
+	if len(r.Actions) == 0 {
+		fail("actions", "at least one action is required")
+	}
+
+	rule := &compiledRule{HeaderRule: r}
+	for i, action := range r.Actions {
+		field := fmt.Sprintf("actions[%d]", i)
+		compiled := compiledAction{HeaderAction: action}
+
+		if action.Name == "" || strings.ContainsAny(action.Name, " \t\r\n:") {
+			fail(field+".name", "must be a header name, got %q", action.Name)
+		}
+
+		switch action.Op {
+		case HeaderSet, HeaderAppend, HeaderReplace:
+		case HeaderRemove:
+			if action.Value != "" || action.Pattern != "" {
+				fail(field, "remove takes no value or pattern")
+			}
+		default:
+			fail(field+".op", "must be one of set, append, remove or replace, got %q", action.Op)
+		}
+
+		if action.Op == HeaderReplace {
+			pattern, err := regexp.Compile(action.Pattern)
+			if err != nil || action.Pattern == "" {
+				fail(field+".pattern", "replace needs a valid regular expression")
+			}
+			compiled.pattern = pattern
+		}
+
+		value, err := template.New(action.Name).Funcs(headerTemplateFuncs).Parse(action.Value)
+		if err == nil {
+			err = value.Execute(io.Discard, HeaderVars{})
+		}
+		if err != nil {
+			fail(field+".value", "%v", err)
+		}
+		compiled.value = value
+
+		rule.actions = append(rule.actions, compiled)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (r *compiledRule) matches(req *http.Request, status int, contentType string) bool {
+	m := r.Match
+
+	if len(m.Hosts) > 0 && !slices.ContainsFunc(m.Hosts, func(pattern string) bool {
+		return matchHost(pattern, req.URL.Host)
+	}) {
+		return false
+	}
+	if len(m.Paths) > 0 && !slices.ContainsFunc(m.Paths, func(prefix string) bool {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}) {
+		return false
+	}
+	if len(m.Methods) > 0 && !slices.ContainsFunc(m.Methods, func(method string) bool {
+		return strings.EqualFold(method, req.Method)
+	}) {
+		return false
+	}
+	if len(m.Statuses) > 0 && !slices.Contains(m.Statuses, status) {
+		return false
+	}
+	if len(m.ContentTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if !slices.ContainsFunc(m.ContentTypes, func(pattern string) bool {
+			return matchMediaType(pattern, mediaType)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *compiledRule) apply(header http.Header, vars HeaderVars) {
+	for _, action := range r.actions {
+		var value strings.Builder
+		if err := action.value.Execute(&value, vars); err != nil {
+			continue
+		}
+
+		switch action.Op {
+		case HeaderSet:
+			header.Set(action.Name, value.String())
+		case HeaderAppend:
+			header.Add(action.Name, value.String())
+		case HeaderRemove:
+			header.Del(action.Name)
+		case HeaderReplace:
+			key := http.CanonicalHeaderKey(action.Name)
+			if len(header[key]) == 0 {
+				continue
+			}
+			replaced := make([]string, len(header[key]))
+			for i, v := range header[key] {
+				replaced[i] = action.pattern.ReplaceAllString(v, value.String())
+			}
+			header[key] = replaced
+		}
+	}
+}
+
+// HeaderRules is a compiled list of HeaderRule.
+type HeaderRules struct {
+	rules []*compiledRule
+}
+
+// NewHeaderRules compiles rules and reports every invalid one.
+func NewHeaderRules(rules []HeaderRule) (*HeaderRules, error) {
+	var errs []error
+	compiled := &HeaderRules{}
+	for i, rule := range rules {
+		c, err := rule.compile()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("[%d]: %w", i, err))
+			continue
+		}
+		compiled.rules = append(compiled.rules, c)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// ApplyRequest applies the request rules that match req to its headers.
+func (h *HeaderRules) ApplyRequest(req *http.Request, vars HeaderVars) {
+	if h == nil {
+		return
+	}
+
+	for _, rule := range h.rules {
+		if rule.Phase != HeaderPhaseRequest || !rule.matches(req, 0, req.Header.Get("Content-Type")) {
+			continue
+		}
+		rule.apply(req.Header, vars)
+	}
+}
+
+// ApplyResponse applies the response rules that match resp to its headers.
+// Request matches are checked against resp.Request.
+func (h *HeaderRules) ApplyResponse(resp *http.Response, vars HeaderVars) {
+	if h == nil || resp.Request == nil {
+		return
+	}
+
+	for _, rule := range h.rules {
+		if rule.Phase != HeaderPhaseResponse || !rule.matches(resp.Request, resp.StatusCode, resp.Header.Get("Content-Type")) {
+			continue
+		}
+		rule.apply(resp.Header, vars)
+	}
+}
+
+type headerTransport struct {
+	base  http.RoundTripper
+	rules *HeaderRules
+	vars  HeaderVars
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.rules == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	t.rules.ApplyRequest(req, t.vars.forRequest(req))
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	t.Setenv("PROXY_HDR_BILLING_API_KEY", "secret")
+
+	rules, err := NewHeaderRules([]HeaderRule{
+		{
+			Phase:   HeaderPhaseRequest,
+			Match:   HeaderMatch{Hosts: []string{"billing.example.com"}},
+			Actions: []HeaderAction{{Op: HeaderSet, Name: "X-API-Key", Value: `{{env "PROXY_HDR_BILLING_API_KEY"}}`}},
+		},
+		{
+			Phase: HeaderPhaseRequest,
+			Match: HeaderMatch{Methods: []string{"post"}, Paths: []string{"/upload"}},
+			Actions: []HeaderAction{
+				{Op: HeaderSet, Name: "User-Agent", Value: "proxy/1.0"},
+				{Op: HeaderAppend, Name: "X-Forwarded-For", Value: "{{.ClientIP}}"},
+				{Op: HeaderSet, Name: "X-Session", Value: "{{.SessionID}}-{{.Principal}}"},
+			},
+		},
+		{
+			Phase:   HeaderPhaseRequest,
+			Actions: []HeaderAction{{Op: HeaderReplace, Name: "Referer", Pattern: `^https?://[^/]+`, Value: "https://proxy.example"}},
+		},
+		{
+			Phase: HeaderPhaseResponse,
+			Match: HeaderMatch{Statuses: []int{200}, ContentTypes: []string{"text/*"}},
+			Actions: []HeaderAction{
+				{Op: HeaderRemove, Name: "X-Frame-Options"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	vars := HeaderVars{SessionID: "42", ClientIP: "10.0.0.1", Principal: "alice"}
+
+	requestCases := []struct {
+		name   string
+		method string
+		url    string
+		header http.Header
+		expect http.Header
+	}{
+		{
+			name:   "api key by host",
+			method: http.MethodGet,
+			url:    "https://billing.example.com/invoices",
+			expect: http.Header{"X-Api-Key": {"secret"}},
+		},
+		{
+			name:   "method and path match with variables",
+			method: http.MethodPost,
+			url:    "https://files.example.com/upload/a",
+			header: http.Header{"User-Agent": {"curl/8"}, "X-Forwarded-For": {"192.0.2.1"}},
+			expect: http.Header{
+				"User-Agent":      {"proxy/1.0"},
+				"X-Forwarded-For": {"192.0.2.1", "10.0.0.1"},
+				"X-Session":       {"42-alice"},
+			},
+		},
+		{
+			name:   "no match",
+			method: http.MethodGet,
+			url:    "https://files.example.com/upload/a",
+			header: http.Header{"User-Agent": {"curl/8"}},
+			expect: http.Header{"User-Agent": {"curl/8"}},
+		},
+		{
+			name:   "regex replace",
+			method: http.MethodGet,
+			url:    "https://files.example.com/",
+			header: http.Header{"Referer": {"http://internal.corp/page?x=1"}},
+			expect: http.Header{"Referer": {"https://proxy.example/page?x=1"}},
+		},
+	}
+
+	for _, tc := range requestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, nil)
+			for key, values := range tc.header {
+				req.Header[key] = values
+			}
+
+			rules.ApplyRequest(req, vars)
+
+			for key, values := range tc.expect {
+				if got := req.Header.Values(key); strings.Join(got, ",") != strings.Join(values, ",") {
+					t.Errorf("expected %s %v, got %v", key, values, got)
+				}
+			}
+		})
+	}
+
+	responseCases := []struct {
+		name        string
+		status      int
+		contentType string
+		removed     bool
+	}{
+		{"matching response", http.StatusOK, "text/html; charset=utf-8", true},
+		{"other status", http.StatusNotFound, "text/html", false},
+		{"other content type", http.StatusOK, "application/json", false},
+	}
+
+	for _, tc := range responseCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tc.status,
+				Header:     http.Header{"Content-Type": {tc.contentType}, "X-Frame-Options": {"DENY"}},
+				Request:    httptest.NewRequest(http.MethodGet, "https://example.com/", nil),
+			}
+
+			rules.ApplyResponse(resp, vars)
+
+			if removed := resp.Header.Get("X-Frame-Options") == ""; removed != tc.removed {
+				t.Errorf("expected removed %v, got %v", tc.removed, removed)
+			}
+		})
+	}
+}
+
+func TestHeaderRuleValidation(t *testing.T) {
+	testCases := []struct {
+		name        string
+		rule        HeaderRule
+		expectError string
+	}{
+		{
+			name:        "unknown phase",
+			rule:        HeaderRule{Phase: "both", Actions: []HeaderAction{{Op: HeaderRemove, Name: "X-A"}}},
+			expectError: "phase",
+		},
+		{
+			name:        "status on request rule",
+			rule:        HeaderRule{Phase: HeaderPhaseRequest, Match: HeaderMatch{Statuses: []int{200}}, Actions: []HeaderAction{{Op: HeaderRemove, Name: "X-A"}}},
+			expectError: "match.statuses",
+		},
+		{
+			name:        "unknown op",
+			rule:        HeaderRule{Phase: HeaderPhaseRequest, Actions: []HeaderAction{{Op: "rename", Name: "X-A"}}},
+			expectError: "actions[0].op",
+		},
+		{
+			name:        "bad regex",
+			rule:        HeaderRule{Phase: HeaderPhaseResponse, Actions: []HeaderAction{{Op: HeaderReplace, Name: "X-A", Pattern: "("}}},
+			expectError: "actions[0].pattern",
+		},
+		{
+			name:        "unknown variable",
+			rule:        HeaderRule{Phase: HeaderPhaseRequest, Actions: []HeaderAction{{Op: HeaderSet, Name: "X-A", Value: "{{.Nope}}"}}},
+			expectError: "actions[0].value",
+		},
+		{
+			name:        "env outside the allowed prefix",
+			rule:        HeaderRule{Phase: HeaderPhaseRequest, Actions: []HeaderAction{{Op: HeaderSet, Name: "X-A", Value: `{{env "AWS_SECRET_ACCESS_KEY"}}`}}},
+			expectError: "PROXY_HDR_",
+		},
+		{
+			name:        "bad header name",
+			rule:        HeaderRule{Phase: HeaderPhaseRequest, Actions: []HeaderAction{{Op: HeaderSet, Name: "X A"}}},
+			expectError: "actions[0].name",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.rule.compile()
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("expected error containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Seen-User-Agent", r.Header.Get("User-Agent"))
+		w.Write([]byte("ok"))
+	}))
+	defer service.Close()
+
+	rules, err := NewHeaderRules([]HeaderRule{
+		{Phase: HeaderPhaseRequest, Actions: []HeaderAction{{Op: HeaderSet, Name: "User-Agent", Value: "proxy for {{.ClientIP}}"}}},
+		{Phase: HeaderPhaseResponse, Actions: []HeaderAction{{Op: HeaderRemove, Name: "X-Frame-Options"}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	policy := DefaultPolicy()
+	policy.Headers = rules
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+	r.RemoteAddr = "198.51.100.7:5555"
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, r)
+
+	if got := w.Header().Get("X-Seen-User-Agent"); got != "proxy for 198.51.100.7" {
+		t.Errorf("expected rewritten user agent upstream, got %q", got)
+	}
+	if w.Header().Get("X-Frame-Options") != "" {
+		t.Errorf("expected X-Frame-Options to be stripped")
+	}
+}
+
+func TestProxyHeaderRulesOnRedirect(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-API-Key", r.Header.Get("X-API-Key"))
+		w.Header().Set("X-Frame-Options", "DENY")
+	}))
+	defer other.Close()
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			http.Error(w, "missing key", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1)+"/landing", http.StatusFound)
+	}))
+	defer service.Close()
+
+	rules, err := NewHeaderRules([]HeaderRule{
+		{Phase: HeaderPhaseRequest, Match: HeaderMatch{Hosts: []string{"127.0.0.1"}}, Actions: []HeaderAction{{Op: HeaderSet, Name: "X-API-Key", Value: "secret"}}},
+		{Phase: HeaderPhaseResponse, Match: HeaderMatch{Hosts: []string{"localhost"}}, Actions: []HeaderAction{{Op: HeaderRemove, Name: "X-Frame-Options"}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	policy := DefaultPolicy()
+	policy.Headers = rules
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.buffer.String())
+	}
+	if got := w.Header().Get("X-Seen-API-Key"); got != "" {
+		t.Errorf("expected the API key to stay on its host, got %q on the redirect target", got)
+	}
+	if w.Header().Get("X-Frame-Options") != "" {
+		t.Errorf("expected response rules to match the final host")
+	}
+}
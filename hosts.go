@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+func matchHost(pattern, hostport string) bool {
+	pattern = strings.ToLower(pattern)
+	host := hostOnly(hostport)
+
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return host == pattern
+	}
+}
+
+func validHostPattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("empty host pattern")
+	}
+
+	if strings.ContainsAny(pattern, " /:?#") {
+		return fmt.Errorf("host pattern %q must be a bare host name", pattern)
+	}
+
+	if strings.Contains(strings.TrimPrefix(pattern, "*."), "*") && pattern != "*" {
+		return fmt.Errorf("host pattern %q may only use a leading \"*.\" wildcard", pattern)
+	}
+
+	return nil
+}
+
+// HostPolicy restricts the upstream hosts. Deny wins over Allow, and a
+// non-empty Allow rejects every host it does not match.
+type HostPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// PolicyError is returned when a policy rejects a request or response.
+type PolicyError struct {
+	Host   string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Host, e.Reason)
+}
+
+func (h HostPolicy) check(host string) error {
+	for _, pattern := range h.Deny {
+		if matchHost(pattern, host) {
+			return &PolicyError{Host: hostOnly(host), Reason: "host is denied by policy"}
+		}
+	}
+
+	if len(h.Allow) == 0 {
+		return nil
+	}
+
+	for _, pattern := range h.Allow {
+		if matchHost(pattern, host) {
+			return nil
+		}
+	}
+
+	return &PolicyError{Host: hostOnly(host), Reason: "host is not in the allow list"}
+}
+
+func (h HostPolicy) validate() error {
+	var errs []error
+	for _, pattern := range append(append([]string(nil), h.Allow...), h.Deny...) {
+		errs = append(errs, validHostPattern(pattern))
+	}
+	return errors.Join(errs...)
+}
+
+type policyTransport struct {
+	base  http.RoundTripper
+	hosts HostPolicy
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.hosts.check(req.URL.Host); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
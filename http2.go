@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Config sets HTTP/2 for clients and upstreams. H2C serves cleartext
+// HTTP/2, with prior knowledge or through an Upgrade.
+type HTTP2Config struct {
+	H2C      bool          `json:"h2c"`
+	Upstream UpstreamHTTP2 `json:"upstream"`
+}
+
+// UpstreamHTTP2 sets HTTP/2 to upstreams. Disable forces HTTP/1.1; hosts in
+// H2CHosts get cleartext HTTP/2 with prior knowledge.
+type UpstreamHTTP2 struct {
+	Disable  bool     `json:"disable"`
+	H2CHosts []string `json:"h2c_hosts,omitempty"`
+}
+
+func (u UpstreamHTTP2) h2c(host string) bool {
+	return slices.ContainsFunc(u.H2CHosts, func(pattern string) bool {
+		return matchHost(pattern, host)
+	})
+}
+
+// NewServer returns a server for handler that speaks HTTP/1.1 and HTTP/2, and
+// cleartext HTTP/2 when cfg.H2C is set.
+func NewServer(handler http.Handler, cfg HTTP2Config) *http.Server {
+	srv := &http.Server{Handler: handler, Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+
+	if cfg.H2C {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+
+		upgrade := &h2cUpgradeHandler{next: handler, h2: &http2.Server{}}
+		srv.Handler = upgrade
+
+		// Upgraded connections belong to srv, so Shutdown sends them a GOAWAY.
+		http2.ConfigureServer(srv, upgrade.h2)
+	}
+
+	return srv
+}
+
+type h2cUpgradeHandler struct {
+	next    http.Handler
+	h2      *http2.Server
+	tunnels tunnelSet
+}
+
+func (h *h2cUpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	settings, ok := h2cUpgradeSettings(r)
+	if !ok {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	defer conn.Close()
+
+	done := h.tunnels.add(conn)
+	defer done()
+
+	r.Header.Del("Upgrade")
+	r.Header.Del("HTTP2-Settings")
+	r.Header.Del("Connection")
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+		return
+	}
+
+	h.h2.ServeConn(&bufferedConn{Conn: conn, r: rw.Reader}, &http2.ServeConnOpts{
+		Context:        r.Context(),
+		Handler:        h.next,
+		UpgradeRequest: r,
+		Settings:       settings,
+	})
+}
+
+func h2cUpgradeSettings(r *http.Request) ([]byte, bool) {
+	if r.ProtoMajor != 1 || r.ContentLength != 0 || len(r.TransferEncoding) > 0 {
+		return nil, false
+	}
+	if !headerHasToken(r.Header, "Upgrade", "h2c") || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Connection", "http2-settings") {
+		return nil, false
+	}
+
+	values := r.Header.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil {
+		return nil, false
+	}
+
+	return settings, true
+}
+
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type protocolTransport struct {
+	direct   *http.Transport
+	http1    *http.Transport
+	h2c      *http.Transport
+	settings UpstreamHTTP2
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case req.URL.Scheme == "http" && t.settings.h2c(req.URL.Host):
+		return t.h2c.RoundTrip(req)
+	case t.settings.Disable:
+		return t.http1.RoundTrip(req)
+	default:
+		return t.direct.RoundTrip(req)
+	}
+}
+
+func newProtocolTransports(direct *http.Transport) (http1, h2c *http.Transport) {
+	http1 = direct.Clone()
+	http1.Protocols = new(http.Protocols)
+	http1.Protocols.SetHTTP1(true)
+	if http1.TLSClientConfig != nil {
+		http1.TLSClientConfig.NextProtos = slices.DeleteFunc(slices.Clone(http1.TLSClientConfig.NextProtos), func(proto string) bool {
+			return proto == "h2"
+		})
+	}
+
+	h2c = direct.Clone()
+	h2c.Proxy = nil
+	h2c.Protocols = new(http.Protocols)
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+
+	return http1, h2c
+}
+
+func streamingResponse(resp *http.Response) bool {
+	if len(resp.Trailer) > 0 || resp.StatusCode == http.StatusPartialContent || multipartByteranges(resp) {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+func streamResponse(w http.ResponseWriter, resp *http.Response) {
+	w.WriteHeader(resp.StatusCode)
+	copyBody(w, w, resp.Body)
+	copyTrailers(w, resp.Trailer)
+}
+
+func copyBody(w http.ResponseWriter, dst io.Writer, body io.Reader) {
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				panic(http.ErrAbortHandler)
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+func copyTrailers(w http.ResponseWriter, trailer http.Header) {
+	for key, values := range trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func protoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+}
+
+func h2cClient() *http.Client {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+func serveHTTP2(t *testing.T, handler http.Handler, cfg HTTP2Config) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	srv := NewServer(handler, cfg)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func TestServerH2CPriorKnowledge(t *testing.T) {
+	testCases := []struct {
+		name    string
+		h2c     bool
+		success bool
+	}{
+		{"h2c enabled", true, true},
+		{"h2c disabled", false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := serveHTTP2(t, protoHandler(), HTTP2Config{H2C: tc.h2c})
+
+			resp, err := h2cClient().Get("http://" + addr)
+			if !tc.success {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected prior knowledge h2c to fail when disabled")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "HTTP/2.0" {
+				t.Errorf("expected HTTP/2.0, got %q", body)
+			}
+		})
+	}
+}
+
+func TestServerH2CUpgrade(t *testing.T) {
+	addr := serveHTTP2(t, protoHandler(), HTTP2Config{H2C: true})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	settings := base64.RawURLEncoding.EncodeToString(nil)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: "+settings+"\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	io.WriteString(conn, http2.ClientPreface)
+	framer := http2.NewFramer(conn, br)
+	framer.WriteSettings()
+
+	var status, body string
+	decoder := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		if f.Name == ":status" {
+			status = f.Value
+		}
+	})
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if frame.Header().StreamID != 1 {
+			continue
+		}
+
+		switch f := frame.(type) {
+		case *http2.HeadersFrame:
+			decoder.Write(f.HeaderBlockFragment())
+		case *http2.DataFrame:
+			body += string(f.Data())
+		}
+		if frame.Header().Flags.Has(http2.FlagDataEndStream) {
+			break
+		}
+	}
+
+	if status != "200" || body != "HTTP/2.0" {
+		t.Errorf("expected 200 HTTP/2.0 on the upgraded stream, got %s %q", status, body)
+	}
+}
+
+func TestServerH2CUpgradeWithBody(t *testing.T) {
+	addr := serveHTTP2(t, protoHandler(), HTTP2Config{H2C: true})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr, strings.NewReader("payload"))
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", "")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "HTTP/1.1" {
+		t.Errorf("expected the upgrade to be ignored, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestServerHTTP2OverTLS(t *testing.T) {
+	dir := t.TempDir()
+	tlsConfig, err := NewTLSServerConfig(TLSConfig{Dev: true, DevDir: dir})
+	if err != nil {
+		t.Fatalf("failed to build TLS config: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewServer(protoHandler(), HTTP2Config{})
+	go srv.Serve(tls.NewListener(ln, tlsConfig))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{RootCAs: caPool(t, filepath.Join(dir, "ca.pem"))},
+	}}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	resp, err := client.Get("https://localhost:" + port)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected h2 to be negotiated over ALPN, got %s", resp.Proto)
+	}
+}
+
+func TestProxyUpstreamProtocols(t *testing.T) {
+	h2cService := serveHTTP2(t, protoHandler(), HTTP2Config{H2C: true})
+
+	tlsService := httptest.NewUnstartedServer(protoHandler())
+	tlsService.EnableHTTP2 = true
+	tlsService.StartTLS()
+	defer tlsService.Close()
+
+	testCases := []struct {
+		name     string
+		url      string
+		settings UpstreamHTTP2
+		expect   string
+	}{
+		{"h2c host", "http://" + h2cService, UpstreamHTTP2{H2CHosts: []string{"127.0.0.1"}}, "HTTP/2.0"},
+		{"cleartext default", "http://" + h2cService, UpstreamHTTP2{}, "HTTP/1.1"},
+		{"tls negotiates h2", tlsService.URL, UpstreamHTTP2{}, "HTTP/2.0"},
+		{"tls with http2 disabled", tlsService.URL, UpstreamHTTP2{Disable: true}, "HTTP/1.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.HTTP2 = tc.settings
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			roots := tlsService.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+			for _, transport := range []*http.Transport{proxy.direct, proxy.http1} {
+				if transport.TLSClientConfig == nil {
+					transport.TLSClientConfig = &tls.Config{}
+				}
+				transport.TLSClientConfig.RootCAs = roots
+			}
+
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+tc.url, nil))
+
+			if w.Code != http.StatusOK || w.buffer.String() != tc.expect {
+				t.Errorf("expected upstream to see %s, got %d %q", tc.expect, w.Code, w.buffer.String())
+			}
+		})
+	}
+}
+
+func TestProxyGRPCTrailers(t *testing.T) {
+	upstream := serveHTTP2(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+
+		if r.URL.Path == "/reset" {
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Write([]byte("second"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}), HTTP2Config{H2C: true})
+
+	policy := DefaultPolicy()
+	policy.HTTP2 = UpstreamHTTP2{H2CHosts: []string{"127.0.0.1"}}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+	addr := serveHTTP2(t, proxy, HTTP2Config{H2C: true})
+
+	t.Run("trailers", func(t *testing.T) {
+		resp, err := h2cClient().Post("http://"+addr+"/proxy/http://"+upstream+"/ok", "application/grpc", strings.NewReader("req"))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		if string(body) != "firstsecond" {
+			t.Errorf("expected streamed body, got %q", body)
+		}
+		if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+			t.Errorf("expected grpc trailers, got %v", resp.Trailer)
+		}
+	})
+
+	t.Run("stream reset", func(t *testing.T) {
+		resp, err := h2cClient().Post("http://"+addr+"/proxy/http://"+upstream+"/reset", "application/grpc", strings.NewReader("req"))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if _, err := io.ReadAll(resp.Body); err == nil {
+			t.Error("expected the upstream reset to surface as a body read error")
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// BodyLimits caps request and response bodies in bytes. Zero means no limit,
+// except that decoded responses are always capped.
+type BodyLimits struct {
+	MaxRequestBody  int64 `json:"max_request_body,omitempty"`
+	MaxResponseBody int64 `json:"max_response_body,omitempty"`
+}
+
+// defaultMaxDecodedBody caps decompressed response bodies when
+// MaxResponseBody is not set, so a small compressed body cannot expand
+// without bound.
+const defaultMaxDecodedBody = 64 << 20
+
+func (l BodyLimits) decodedLimit() int64 {
+	if l.MaxResponseBody > 0 {
+		return l.MaxResponseBody
+	}
+	return defaultMaxDecodedBody
+}
+
+// BodyTooLargeError is returned when a body goes over its limit. Direction is
+// "request" or names the response that was too large.
+type BodyTooLargeError struct {
+	Direction string
+	Limit     int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("%s body exceeds the limit of %d bytes", e.Direction, e.Limit)
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       *BodyTooLargeError
+}
+
+func newLimitedBody(body io.ReadCloser, direction string, limit int64) *limitedBody {
+	return &limitedBody{
+		ReadCloser: body,
+		remaining:  limit,
+		err:        &BodyTooLargeError{Direction: direction, Limit: limit},
+	}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), b.err
+	}
+	return n, err
+}
+
+// ContentTypeRule filters the media types of responses from hosts matching
+// Hosts. Deny wins over Allow, and a non-empty Allow rejects what it does not
+// list.
+type ContentTypeRule struct {
+	Hosts []string `json:"hosts"`
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+
+	switch {
+	case pattern == "*" || pattern == "*/*":
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(mediaType, pattern[:len(pattern)-1])
+	default:
+		return mediaType == pattern
+	}
+}
+
+func validMediaTypePattern(pattern string) error {
+	if pattern == "*" {
+		return nil
+	}
+
+	major, minor, ok := strings.Cut(pattern, "/")
+	if !ok || major == "" || minor == "" || strings.Contains(minor, "/") || (major == "*" && minor != "*") {
+		return fmt.Errorf("content type pattern %q must look like \"text/html\", \"text/*\" or \"*/*\"", pattern)
+	}
+
+	return nil
+}
+
+func (r ContentTypeRule) validate() error {
+	var errs []error
+	if len(r.Hosts) == 0 {
+		errs = append(errs, errors.New("at least one host pattern is required"))
+	}
+	for _, pattern := range r.Hosts {
+		errs = append(errs, validHostPattern(pattern))
+	}
+	for _, pattern := range append(append([]string(nil), r.Allow...), r.Deny...) {
+		errs = append(errs, validMediaTypePattern(pattern))
+	}
+	return errors.Join(errs...)
+}
+
+func (r ContentTypeRule) check(host, mediaType string) error {
+	for _, pattern := range r.Deny {
+		if matchMediaType(pattern, mediaType) {
+			return &PolicyError{Host: hostOnly(host), Reason: fmt.Sprintf("content type %s is denied by policy", mediaType)}
+		}
+	}
+
+	if len(r.Allow) == 0 {
+		return nil
+	}
+
+	for _, pattern := range r.Allow {
+		if matchMediaType(pattern, mediaType) {
+			return nil
+		}
+	}
+
+	return &PolicyError{Host: hostOnly(host), Reason: fmt.Sprintf("content type %s is not in the allow list", mediaType)}
+}
+
+func contentTypeRuleFor(rules []ContentTypeRule, host string) *ContentTypeRule {
+	for i, rule := range rules {
+		for _, pattern := range rule.Hosts {
+			if matchHost(pattern, host) {
+				return &rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// filtersContentType reports whether content-type rules apply to resp. Only
+// a final response with a body is filtered; redirects are followed, and 1xx,
+// 204 and 304 responses and HEAD requests have no body to check.
+func filtersContentType(resp *http.Response) bool {
+	switch {
+	case resp.Request != nil && resp.Request.Method == http.MethodHead:
+		return false
+	case resp.StatusCode < 200 || resp.StatusCode/100 == 3 || resp.StatusCode == http.StatusNoContent:
+		return false
+	}
+	return resp.ContentLength != 0
+}
+
+// responseMediaType returns the media type of resp, sniffing the body when
+// there is no Content-Type. It returns "" for an empty body.
+func responseMediaType(resp *http.Response) string {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		br := bufio.NewReader(resp.Body)
+		peeked, _ := br.Peek(512)
+		if len(peeked) == 0 {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{br, resp.Body}
+			return ""
+		}
+		contentType = http.DetectContentType(peeked)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{br, resp.Body}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+	}
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+type contentTransport struct {
+	base         http.RoundTripper
+	limits       BodyLimits
+	contentTypes []ContentTypeRule
+}
+
+func (t *contentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if limit := t.limits.MaxRequestBody; limit > 0 && req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > limit {
+			return nil, &BodyTooLargeError{Direction: "request", Limit: limit}
+		}
+
+		req = req.Clone(req.Context())
+		req.Body = newLimitedBody(req.Body, "request", limit)
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return newLimitedBody(body, "request", limit), nil
+			}
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rule := contentTypeRuleFor(t.contentTypes, req.URL.Host); rule != nil && filtersContentType(resp) {
+		if mediaType := responseMediaType(resp); mediaType != "" {
+			if err := rule.check(req.URL.Host, mediaType); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if limit := t.limits.MaxResponseBody; limit > 0 {
+		if resp.ContentLength > limit {
+			resp.Body.Close()
+			return nil, &BodyTooLargeError{Direction: "response", Limit: limit}
+		}
+
+		resp.Body = newLimitedBody(resp.Body, "response", limit)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyBodyLimits(t *testing.T) {
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				return
+			}
+			if r.URL.Query().Has("stream") {
+				w.Write([]byte(strings.Repeat("x", 1024)))
+				w.(http.Flusher).Flush()
+				w.Write([]byte(strings.Repeat("x", 1024)))
+				return
+			}
+			w.Write([]byte(strings.Repeat("x", 2048)))
+		}),
+	)
+	defer service.Close()
+
+	testCases := []struct {
+		name          string
+		path          string
+		body          io.Reader
+		contentLength int64
+		status        int
+	}{
+		{
+			name:          "declared request length over limit",
+			path:          "/proxy/" + service.URL,
+			body:          strings.NewReader(strings.Repeat("x", 200)),
+			contentLength: 200,
+			status:        http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "streamed request over limit",
+			path:          "/proxy/" + service.URL,
+			body:          io.MultiReader(strings.NewReader(strings.Repeat("x", 200))),
+			contentLength: -1,
+			status:        http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "declared response length over limit",
+			path:   "/proxy/" + service.URL,
+			status: http.StatusBadGateway,
+		},
+		{
+			name:   "streamed response over limit",
+			path:   "/proxy/" + service.URL + "?stream",
+			status: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.Limits = BodyLimits{MaxRequestBody: 100, MaxResponseBody: 1500}
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			r := httptest.NewRequest(http.MethodPost, tc.path, tc.body)
+			r.ContentLength = tc.contentLength
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.buffer.String())
+			}
+			if !strings.Contains(w.buffer.String(), "exceeds the limit") {
+				t.Errorf("expected size limit error, got %q", w.buffer.String())
+			}
+		})
+	}
+
+	t.Run("within limits", func(t *testing.T) {
+		policy := DefaultPolicy()
+		policy.Limits = BodyLimits{MaxRequestBody: 100, MaxResponseBody: 4096}
+		proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/proxy/"+service.URL+"?stream", strings.NewReader("ok")))
+
+		if w.Code != http.StatusOK || w.buffer.Len() != 2048 {
+			t.Errorf("expected full 2048 byte body, got %d with %d bytes", w.Code, w.buffer.Len())
+		}
+	})
+}
+
+func TestProxyContentTypeRules(t *testing.T) {
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/app.exe":
+				w.Header().Set("Content-Type", "application/x-msdownload")
+				w.Write([]byte("MZ"))
+			case "/page":
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write([]byte("<html></html>"))
+			case "/sniffed":
+				w.Header()["Content-Type"] = nil
+				w.Write([]byte("%PDF-1.7"))
+			case "/moved":
+				w.Header().Set("Content-Type", "application/x-msdownload")
+				w.Header().Set("Location", "/data.json")
+				w.WriteHeader(http.StatusFound)
+				w.Write([]byte("MZ"))
+			case "/empty":
+				w.WriteHeader(http.StatusNoContent)
+			case "/chunked-empty":
+				w.Header()["Content-Type"] = nil
+				w.(http.Flusher).Flush()
+
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte("{}"))
+			}
+		}),
+	)
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.ContentTypes = []ContentTypeRule{
+		{Hosts: []string{"127.0.0.1"}, Allow: []string{"text/*", "application/json"}, Deny: []string{"text/csv"}},
+	}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/page", http.StatusOK},
+		{"/data.json", http.StatusOK},
+		{"/app.exe", http.StatusForbidden},
+		{"/sniffed", http.StatusForbidden},
+		{"/moved", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Errorf("expected status code %d, got %d: %s", tc.status, w.Code, w.buffer.String())
+			}
+		})
+	}
+
+	t.Run("bodiless responses", func(t *testing.T) {
+		policy := DefaultPolicy()
+		policy.ContentTypes = []ContentTypeRule{{Hosts: []string{"*"}, Allow: []string{"application/json"}}}
+		proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+		for path, status := range map[string]int{"/empty": http.StatusNoContent, "/chunked-empty": http.StatusOK} {
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+path, nil))
+
+			if w.Code != status {
+				t.Errorf("%s: expected status code %d, got %d: %s", path, status, w.Code, w.buffer.String())
+			}
+		}
+	})
+}
+
+func TestMatchMediaType(t *testing.T) {
+	testCases := []struct {
+		pattern   string
+		mediaType string
+		match     bool
+	}{
+		{"*/*", "application/json", true},
+		{"*", "text/plain", true},
+		{"text/*", "text/html", true},
+		{"text/*", "application/json", false},
+		{"application/json", "application/json", true},
+		{"Application/JSON", "application/json", true},
+		{"application/json", "application/json-seq", false},
+	}
+
+	for _, tc := range testCases {
+		if got := matchMediaType(tc.pattern, tc.mediaType); got != tc.match {
+			t.Errorf("matchMediaType(%q, %q) = %v, want %v", tc.pattern, tc.mediaType, got, tc.match)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Option configures a Proxy built by NewProxy.
+type Option func(*Proxy)
+
+// RequestModifier edits the outgoing upstream request before header rules
+// run. A returned error aborts the request and is reported to the client.
+type RequestModifier func(req *http.Request) error
+
+// ResponseModifier edits the upstream response before it is streamed,
+// transformed or buffered. It may replace resp.Body; the proxy closes the
+// replacement. A returned error is reported to the client.
+type ResponseModifier func(resp *http.Response) error
+
+// ErrorHandler renders a failed request. problem is the classified error and
+// err the original one.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, problem *Problem, err error)
+
+// SessionResolver picks the session for a request. Returning an empty string
+// falls back to the proxy-session-id cookie.
+type SessionResolver func(w http.ResponseWriter, r *http.Request) string
+
+// WithCircuitBreaker trips a per-host circuit breaker after repeated upstream
+// failures.
+func WithCircuitBreaker(cfg BreakerConfig) Option {
+	return func(p *Proxy) {
+		p.breakers = newBreakerSet(cfg)
+	}
+}
+
+// WithTimeouts sets the per-phase upstream timeouts. They replace the
+// timeouts of every policy the proxy is given, whatever the option order.
+func WithTimeouts(cfg TimeoutConfig) Option {
+	return func(p *Proxy) {
+		p.timeouts = &cfg
+		p.SetPolicy(p.Policy())
+	}
+}
+
+// WithPolicy replaces the default policy. Use SetPolicy to change it later.
+func WithPolicy(policy *Policy) Option {
+	return func(p *Proxy) {
+		p.SetPolicy(policy)
+	}
+}
+
+// WithLogger sets the logger for upstream failures and policy decisions.
+func WithLogger(logger *slog.Logger) Option {
+	return func(p *Proxy) {
+		p.logger = logger
+	}
+}
+
+// WithTransformer adds a response transform that runs before the transforms
+// in the policy.
+func WithTransformer(rule TransformRule) Option {
+	return func(p *Proxy) {
+		p.transforms = append(p.transforms, rule)
+	}
+}
+
+// WithRequestModifier adds a RequestModifier. Modifiers run in the order they
+// are added.
+func WithRequestModifier(modifier RequestModifier) Option {
+	return func(p *Proxy) {
+		p.requestModifiers = append(p.requestModifiers, modifier)
+	}
+}
+
+// WithResponseModifier adds a ResponseModifier. Modifiers run in the order
+// they are added.
+func WithResponseModifier(modifier ResponseModifier) Option {
+	return func(p *Proxy) {
+		p.responseModifiers = append(p.responseModifiers, modifier)
+	}
+}
+
+// WithErrorHandler replaces the problem+json and HTML error responses.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(p *Proxy) {
+		p.errorHandler = handler
+	}
+}
+
+// WithSessionResolver sets how requests are mapped to sessions.
+func WithSessionResolver(resolver SessionResolver) Option {
+	return func(p *Proxy) {
+		p.sessionResolver = resolver
+	}
+}
+
+// WithSessionStore replaces the in-memory store of cookie jars and session
+// owners.
+func WithSessionStore(store SessionStore) Option {
+	return func(p *Proxy) {
+		p.sessions = store
+	}
+}
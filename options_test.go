@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyHooks(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Tenant", r.Header.Get("X-Tenant"))
+		w.Header().Set("X-Internal", "secret")
+		w.Write([]byte("upstream body"))
+	}))
+	defer service.Close()
+
+	testCases := []struct {
+		name    string
+		opts    []Option
+		status  int
+		body    string
+		headers map[string]string
+	}{
+		{
+			name: "request modifier alters outgoing request",
+			opts: []Option{
+				WithRequestModifier(func(req *http.Request) error {
+					req.Header.Set("X-Tenant", "acme")
+					return nil
+				}),
+			},
+			status:  http.StatusOK,
+			body:    "upstream body",
+			headers: map[string]string{"X-Seen-Tenant": "acme"},
+		},
+		{
+			name: "request modifier rejects with problem",
+			opts: []Option{
+				WithRequestModifier(func(req *http.Request) error {
+					return newProblem(http.StatusForbidden, CodePolicyDenied, "tenant not allowed")
+				}),
+			},
+			status:  http.StatusForbidden,
+			headers: map[string]string{"X-Proxy-Error": string(CodePolicyDenied)},
+		},
+		{
+			name: "response modifiers run in order and may replace the body",
+			opts: []Option{
+				WithResponseModifier(func(resp *http.Response) error {
+					resp.Header.Del("X-Internal")
+					return nil
+				}),
+				WithResponseModifier(func(resp *http.Response) error {
+					body, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					resp.Body = io.NopCloser(strings.NewReader(strings.ToUpper(string(body))))
+					return nil
+				}),
+			},
+			status:  http.StatusOK,
+			body:    "UPSTREAM BODY",
+			headers: map[string]string{"X-Internal": ""},
+		},
+		{
+			name: "response modifier error goes to error handler",
+			opts: []Option{
+				WithResponseModifier(func(resp *http.Response) error {
+					return errors.New("inspection failed")
+				}),
+				WithErrorHandler(func(w http.ResponseWriter, r *http.Request, problem *Problem, err error) {
+					w.Header().Set("X-Original-Error", err.Error())
+					w.WriteHeader(http.StatusTeapot)
+					w.Write([]byte(problem.Code))
+				}),
+			},
+			status:  http.StatusTeapot,
+			body:    string(CodeUpstreamError),
+			headers: map[string]string{"X-Original-Error": "inspection failed"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := NewProxy(&http.Client{}, tc.opts...)
+
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.buffer.String())
+			}
+			if tc.body != "" && w.buffer.String() != tc.body {
+				t.Errorf("expected body %q, got %q", tc.body, w.buffer.String())
+			}
+			for key, value := range tc.headers {
+				if got := w.Header().Get(key); got != value {
+					t.Errorf("expected %s %q, got %q", key, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyErrorHandler(t *testing.T) {
+	var got *Problem
+	proxy := NewProxy(&http.Client{}, WithErrorHandler(func(w http.ResponseWriter, r *http.Request, problem *Problem, err error) {
+		got = problem
+		w.WriteHeader(problem.Status)
+	}))
+
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/elsewhere", nil))
+
+	if got == nil || got.Code != CodeInvalidTarget {
+		t.Fatalf("expected invalid-target problem, got %+v", got)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestProxySessionResolver(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("visit"); err == nil {
+			w.Write([]byte(c.Value))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "visit", Value: "seen"})
+	}))
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{}, WithSessionResolver(func(w http.ResponseWriter, r *http.Request) string {
+		return r.Header.Get("X-Account")
+	}))
+
+	testCases := []struct {
+		name    string
+		account string
+		body    string
+	}{
+		{"first visit for account", "a", ""},
+		{"same account shares jar", "a", "seen"},
+		{"other account has own jar", "b", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+			r.Header.Set("X-Account", tc.account)
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if w.buffer.String() != tc.body {
+				t.Errorf("expected body %q, got %q", tc.body, w.buffer.String())
+			}
+			if w.Header().Get("Set-Cookie") != "" {
+				t.Errorf("expected no session cookie when the resolver supplies one, got %q", w.Header().Get("Set-Cookie"))
+			}
+		})
+	}
+}
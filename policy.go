@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"html/template"
+	"time"
+)
+
+// SessionPolicy sets the MaxAge and Secure attributes of the session cookie.
+type SessionPolicy struct {
+	MaxAge time.Duration
+	Secure bool
+}
+
+// Policy holds the settings a Proxy applies to each request. A Policy is read
+// concurrently and must not be changed after it is passed to SetPolicy.
+type Policy struct {
+	Timeouts     TimeoutConfig
+	Hosts        HostPolicy
+	Session      SessionPolicy
+	Upstream     []UpstreamRule
+	RateLimits   RateLimits
+	Concurrency  ConcurrencyLimits
+	Limits       BodyLimits
+	ContentTypes []ContentTypeRule
+	ErrorPage    *template.Template
+	Compression  CompressionPolicy
+	HTTP2        UpstreamHTTP2
+	GRPC         GRPCPolicy
+	Resume       ResumePolicy
+	Headers      *HeaderRules
+	Transforms   []TransformRule
+	Targets      TargetPolicy
+	Batch        BatchPolicy
+	Politeness   Politeness
+}
+
+// DefaultPolicy returns a policy with secure, hour-long session cookies and
+// every other feature off.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Session: SessionPolicy{
+			MaxAge: time.Hour,
+			Secure: true,
+		},
+	}
+}
+
+// Policy returns the current policy.
+func (p *Proxy) Policy() *Policy {
+	return p.policy.Load()
+}
+
+// SetPolicy swaps in a new policy for subsequent requests. Timeouts set with
+// WithTimeouts are applied to a copy of it.
+func (p *Proxy) SetPolicy(policy *Policy) {
+	if p.timeouts != nil {
+		withTimeouts := *policy
+		withTimeouts.Timeouts = *p.timeouts
+		policy = &withTimeouts
+	}
+	p.policy.Store(policy)
+	p.direct.CloseIdleConnections()
+	p.http1.CloseIdleConnections()
+	p.h2c.CloseIdleConnections()
+}
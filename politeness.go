@@ -0,0 +1,378 @@
+package proxy
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRobotsTTL   = time.Hour
+	robotsErrorTTL     = time.Minute
+	robotsFetchTimeout = 10 * time.Second
+	maxRobotsSize      = 500 << 10
+	maxCrawlDelay      = 24 * time.Hour
+	defaultMaxDelay    = time.Minute
+)
+
+// Politeness makes the proxy follow robots.txt for UserAgent and space out
+// requests to each host by the larger of MinDelay and the Crawl-delay, capped
+// at MaxDelay. Hosts limits it to matching hosts.
+type Politeness struct {
+	Enabled   bool
+	UserAgent string
+	Hosts     []string
+	MinDelay  time.Duration
+	MaxDelay  time.Duration
+	RobotsTTL time.Duration
+}
+
+func (p Politeness) applies(host string) bool {
+	if !p.Enabled {
+		return false
+	}
+	return len(p.Hosts) == 0 || slices.ContainsFunc(p.Hosts, func(pattern string) bool {
+		return matchHost(pattern, host)
+	})
+}
+
+// PolitenessConfig is the JSON form of Politeness.
+type PolitenessConfig struct {
+	Enabled   bool     `json:"enabled"`
+	UserAgent string   `json:"user_agent,omitempty"`
+	Hosts     []string `json:"hosts,omitempty"`
+	MinDelay  Duration `json:"min_delay,omitempty"`
+	MaxDelay  Duration `json:"max_delay,omitempty"`
+	RobotsTTL Duration `json:"robots_ttl,omitempty"`
+}
+
+func (c PolitenessConfig) validate() error {
+	var errs []error
+	if c.Enabled && c.UserAgent == "" {
+		errs = append(errs, errors.New("user_agent is required when enabled"))
+	}
+	for _, pattern := range c.Hosts {
+		errs = append(errs, validHostPattern(pattern))
+	}
+	if c.MinDelay < 0 || c.MaxDelay < 0 || c.RobotsTTL < 0 {
+		errs = append(errs, errors.New("min_delay, max_delay and robots_ttl must not be negative"))
+	}
+	if c.MaxDelay > 0 && c.MaxDelay < c.MinDelay {
+		errs = append(errs, errors.New("max_delay must not be less than min_delay"))
+	}
+	return errors.Join(errs...)
+}
+
+// RobotsError is returned when robots.txt disallows a path. Rule is empty
+// when robots.txt could not be fetched and every path is disallowed.
+type RobotsError struct {
+	Host      string
+	Path      string
+	UserAgent string
+	Rule      string
+}
+
+func (e *RobotsError) Error() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("robots.txt for %s is unavailable, so all paths are disallowed", e.Host)
+	}
+	return fmt.Sprintf("robots.txt for %s disallows %s for %s (Disallow: %s)", e.Host, e.Path, e.UserAgent, e.Rule)
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+type robotsTxt struct {
+	groups      []*robotsGroup
+	unavailable bool
+}
+
+func parseRobots(r io.Reader) *robotsTxt {
+	robots := &robotsTxt{}
+	var group *robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				group = &robotsGroup{}
+				robots.groups = append(robots.groups, group)
+			}
+			inAgents = true
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			if group != nil && value != "" {
+				group.rules = append(group.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			inAgents = false
+			if secs, err := strconv.ParseFloat(value, 64); group != nil && err == nil && secs >= 0 {
+				group.crawlDelay = seconds(min(secs, maxCrawlDelay.Seconds()))
+			}
+		}
+	}
+
+	return robots
+}
+
+func (r *robotsTxt) group(agent string) ([]robotsRule, time.Duration) {
+	token, _, _ := strings.Cut(strings.ToLower(agent), "/")
+
+	for _, want := range []string{strings.TrimSpace(token), "*"} {
+		var rules []robotsRule
+		var delay time.Duration
+		found := false
+		for _, g := range r.groups {
+			if slices.Contains(g.agents, want) {
+				found = true
+				rules = append(rules, g.rules...)
+				delay = max(delay, g.crawlDelay)
+			}
+		}
+		if found {
+			return rules, delay
+		}
+	}
+
+	return nil, 0
+}
+
+func (r *robotsTxt) disallowedBy(agent, path string) (robotsRule, bool) {
+	if path == "/robots.txt" {
+		return robotsRule{}, false
+	}
+	if r.unavailable {
+		return robotsRule{}, true
+	}
+
+	rules, _ := r.group(agent)
+	var best robotsRule
+	matched := false
+	for _, rule := range rules {
+		if !matchRobotsPattern(rule.pattern, path) {
+			continue
+		}
+		if !matched || len(rule.pattern) > len(best.pattern) || len(rule.pattern) == len(best.pattern) && rule.allow {
+			best, matched = rule, true
+		}
+	}
+
+	return best, matched && !best.allow
+}
+
+func matchRobotsPattern(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	if len(parts) == 1 {
+		return !anchored || len(path) == len(parts[0])
+	}
+
+	pos := len(parts[0])
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(path[pos:], part)
+		if i < 0 {
+			return false
+		}
+		pos += i + len(part)
+	}
+
+	if anchored {
+		return len(path)-len(last) >= pos && strings.HasSuffix(path, last)
+	}
+	return strings.Contains(path[pos:], last)
+}
+
+type robotsEntry struct {
+	ready   chan struct{}
+	robots  *robotsTxt
+	expires time.Time
+}
+
+type politeness struct {
+	mu        sync.Mutex
+	robots    map[string]*robotsEntry
+	next      map[string]time.Time
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+func newPoliteness() *politeness {
+	return &politeness{
+		robots: make(map[string]*robotsEntry),
+		next:   make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+func (p *politeness) robotsFor(ctx context.Context, fetch http.RoundTripper, origin string, settings Politeness) (*robotsTxt, error) {
+	p.mu.Lock()
+	entry := p.robots[origin]
+	if entry != nil {
+		select {
+		case <-entry.ready:
+			if p.now().After(entry.expires) {
+				entry = nil
+			}
+		default:
+		}
+	}
+	if entry == nil {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		p.robots[origin] = entry
+		p.mu.Unlock()
+
+		robots, ttl := fetchRobots(fetch, origin, settings.UserAgent)
+		if ttl == 0 {
+			ttl = cmp.Or(settings.RobotsTTL, defaultRobotsTTL)
+		}
+		entry.robots, entry.expires = robots, p.now().Add(ttl)
+		close(entry.ready)
+		return robots, nil
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		return entry.robots, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func fetchRobots(fetch http.RoundTripper, origin, agent string) (*robotsTxt, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), robotsFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return &robotsTxt{unavailable: true}, robotsErrorTTL
+	}
+	req.Header.Set("User-Agent", agent)
+
+	resp, err := (&http.Client{Transport: fetch}).Do(req)
+	if err != nil {
+		return &robotsTxt{unavailable: true}, robotsErrorTTL
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return parseRobots(io.LimitReader(resp.Body, maxRobotsSize)), 0
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &robotsTxt{}, 0
+	}
+	return &robotsTxt{unavailable: true}, robotsErrorTTL
+}
+
+// wait blocks until host is free and then holds it for delay. Waiting
+// requests hold no slot, so a cancelled one does not delay the others.
+func (p *politeness) wait(ctx context.Context, host string, delay time.Duration) error {
+	for {
+		p.mu.Lock()
+		now := p.now()
+		p.sweep(now)
+
+		next := p.next[host]
+		if !next.After(now) {
+			if delay > 0 {
+				p.next[host] = now.Add(delay)
+			}
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+
+		if err := sleepContext(ctx, next.Sub(now)); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *politeness) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < time.Minute {
+		return
+	}
+	p.lastSweep = now
+
+	for host, next := range p.next {
+		if next.Before(now) {
+			delete(p.next, host)
+		}
+	}
+	for origin, entry := range p.robots {
+		select {
+		case <-entry.ready:
+			if now.After(entry.expires) {
+				delete(p.robots, origin)
+			}
+		default:
+		}
+	}
+}
+
+type politenessTransport struct {
+	base     http.RoundTripper
+	fetch    http.RoundTripper
+	crawler  *politeness
+	settings Politeness
+}
+
+func (t *politenessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.settings.applies(req.URL.Host) {
+		return t.base.RoundTrip(req)
+	}
+
+	robots, err := t.crawler.robotsFor(req.Context(), t.fetch, req.URL.Scheme+"://"+req.URL.Host, t.settings)
+	if err != nil {
+		return nil, err
+	}
+
+	path := req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		path += "?" + req.URL.RawQuery
+	}
+	if rule, disallowed := robots.disallowedBy(t.settings.UserAgent, path); disallowed {
+		return nil, &RobotsError{Host: req.URL.Host, Path: path, UserAgent: t.settings.UserAgent, Rule: rule.pattern}
+	}
+
+	_, crawlDelay := robots.group(t.settings.UserAgent)
+	crawlDelay = min(crawlDelay, cmp.Or(t.settings.MaxDelay, defaultMaxDelay))
+	if err := t.crawler.wait(req.Context(), req.URL.Host, max(t.settings.MinDelay, crawlDelay)); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
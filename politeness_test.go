@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Crawl-delay: 2
+
+User-agent: AcmeBot
+User-agent: OtherBot
+Disallow: /search*
+Allow: /search/about$
+Disallow: /*.pdf$ # documents
+Crawl-delay: 0.5
+`
+
+func TestRobotsRules(t *testing.T) {
+	robots := parseRobots(strings.NewReader(testRobots))
+
+	testCases := []struct {
+		agent      string
+		path       string
+		disallowed bool
+		rule       string
+	}{
+		{"AcmeBot/2.1", "/search?q=x", true, "/search*"},
+		{"acmebot", "/search/about", false, ""},
+		{"AcmeBot", "/search/about/team", true, "/search*"},
+		{"AcmeBot", "/files/report.pdf", true, "/*.pdf$"},
+		{"AcmeBot", "/files/report.pdf?x=1", false, ""},
+		{"AcmeBot", "/private", false, ""},
+		{"OtherBot", "/search", true, "/search*"},
+		{"SomeBot", "/private/data", true, "/private"},
+		{"SomeBot", "/private/public/a", false, ""},
+		{"SomeBot", "/robots.txt", false, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.agent+" "+tc.path, func(t *testing.T) {
+			rule, disallowed := robots.disallowedBy(tc.agent, tc.path)
+			if disallowed != tc.disallowed {
+				t.Fatalf("expected disallowed %v, got %v", tc.disallowed, disallowed)
+			}
+			if disallowed && rule.pattern != tc.rule {
+				t.Errorf("expected rule %q, got %q", tc.rule, rule.pattern)
+			}
+		})
+	}
+
+	delays := []struct {
+		agent string
+		delay time.Duration
+	}{
+		{"AcmeBot/1.0", 500 * time.Millisecond},
+		{"SomeBot", 2 * time.Second},
+	}
+	for _, tc := range delays {
+		if _, delay := robots.group(tc.agent); delay != tc.delay {
+			t.Errorf("%s: expected crawl delay %v, got %v", tc.agent, tc.delay, delay)
+		}
+	}
+}
+
+func TestMatchRobotsPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/", "/anything", true},
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish", false},
+		{"/fish$", "/fish", true},
+		{"/fish$", "/fish/", false},
+		{"/*.php", "/folder/index.php?x", true},
+		{"/*.php$", "/folder/index.php?x", false},
+		{"/a*b*c$", "/a-b-b-c", true},
+		{"/a*b*c$", "/a-c-b", false},
+		{"/*", "/", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern+" "+tc.path, func(t *testing.T) {
+			if got := matchRobotsPattern(tc.pattern, tc.path); got != tc.match {
+				t.Errorf("expected %v, got %v", tc.match, got)
+			}
+		})
+	}
+}
+
+func TestProxyPoliteness(t *testing.T) {
+	var robotsFetches atomic.Int32
+	var times []time.Time
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			robotsFetches.Add(1)
+			w.Write([]byte("User-agent: AcmeBot\nDisallow: /private\nCrawl-delay: 0.2\n"))
+			return
+		}
+		times = append(times, time.Now())
+	}))
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.Politeness = Politeness{Enabled: true, UserAgent: "AcmeBot/1.0"}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	testCases := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"allowed", "/ok", http.StatusOK},
+		{"disallowed", "/private/x", http.StatusForbidden},
+		{"spaced across sessions", "/ok", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.buffer.String())
+			}
+			if tc.status == http.StatusForbidden {
+				if w.Header().Get("X-Proxy-Error") != string(CodeRobotsDisallowed) {
+					t.Errorf("expected robots-disallowed, got %q", w.Header().Get("X-Proxy-Error"))
+				}
+				if !strings.Contains(w.buffer.String(), "Disallow: /private") {
+					t.Errorf("expected the rule in the problem detail, got %s", w.buffer.String())
+				}
+			}
+		})
+	}
+
+	if robotsFetches.Load() != 1 {
+		t.Errorf("expected robots.txt to be fetched once, got %d", robotsFetches.Load())
+	}
+	if len(times) != 2 || times[1].Sub(times[0]) < 200*time.Millisecond {
+		t.Errorf("expected requests to be spaced by the crawl delay, got %v", times)
+	}
+}
+
+func TestProxyPolitenessRobotsStatus(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status int
+		expect int
+	}{
+		{"missing robots allows all", http.StatusNotFound, http.StatusOK},
+		{"server error disallows all", http.StatusServiceUnavailable, http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/robots.txt" {
+					w.WriteHeader(tc.status)
+				}
+			}))
+			defer service.Close()
+
+			policy := DefaultPolicy()
+			policy.Politeness = Politeness{Enabled: true, UserAgent: "AcmeBot"}
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+"/page", nil))
+
+			if w.Code != tc.expect {
+				t.Errorf("expected status code %d, got %d: %s", tc.expect, w.Code, w.buffer.String())
+			}
+		})
+	}
+}
+
+func TestPolitenessWaitCancelled(t *testing.T) {
+	crawler := newPoliteness()
+	if err := crawler.wait(t.Context(), "example.com", 100*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	if err := crawler.wait(ctx, "example.com", 100*time.Millisecond); err == nil {
+		t.Fatal("expected the cancelled request to stop waiting")
+	}
+
+	start := time.Now()
+	if err := crawler.wait(t.Context(), "example.com", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the cancelled request to give up its slot, waited %v", elapsed)
+	}
+}
+
+func TestProxyPolitenessMaxDelay(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nCrawl-delay: 1e30\n"))
+		}
+	}))
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.Politeness = Politeness{Enabled: true, UserAgent: "AcmeBot", MaxDelay: 50 * time.Millisecond}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	start := time.Now()
+	for range 2 {
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+"/page", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.buffer.String())
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the crawl delay to be capped at 50ms, took %v", elapsed)
+	}
+}
@@ -1,88 +1,292 @@
-package main
+package proxy
 
 import (
+	"bufio"
 	"context"
-	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
-	"net"
 	"net/http"
-	"net/http/cookiejar"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const proxySessionCookie = "proxy-session-id"
+const (
+	proxySessionCookie  = "proxy-session-id"
+	maxBufferedResponse = 1 << 20
+)
 
+// Proxy is an http.Handler that forwards /proxy/<url> requests upstream, with
+// a cookie jar per session and the limits, rules and transforms of its Policy.
 type Proxy struct {
-	cli        *http.Client
-	cookieJars map[string]*cookiejar.Jar
-	mu         sync.RWMutex
+	cli               *http.Client
+	sessions          SessionStore
+	mu                sync.RWMutex
+	breakers          *breakerSet
+	limiter           *rateLimiter
+	queues            *concurrencyLimiter
+	crawler           *politeness
+	policy            atomic.Pointer[Policy]
+	direct            *http.Transport
+	http1             *http.Transport
+	h2c               *http.Transport
+	upstream          *upstreamDialer
+	logger            *slog.Logger
+	transforms        []TransformRule
+	timeouts          *TimeoutConfig
+	requestModifiers  []RequestModifier
+	responseModifiers []ResponseModifier
+	errorHandler      ErrorHandler
+	sessionResolver   SessionResolver
+	active            activeSet
+	tunnels           tunnelSet
+	draining          atomic.Bool
+	drainHooks        []func(context.Context) error
 }
 
-func NewProxy(httpClient *http.Client) *Proxy {
-	return &Proxy{
-		cli:        httpClient,
-		cookieJars: make(map[string]*cookiejar.Jar),
+// NewProxy returns a Proxy that sends requests with httpClient's transport,
+// redirect policy and timeout. A nil Transport uses the proxy's own dialer.
+func NewProxy(httpClient *http.Client, opts ...Option) *Proxy {
+	p := &Proxy{
+		cli:      httpClient,
+		sessions: NewMemorySessionStore(),
+		limiter:  newRateLimiter(),
+		queues:   newConcurrencyLimiter(),
+		crawler:  newPoliteness(),
+		logger:   slog.Default(),
 	}
+	p.policy.Store(DefaultPolicy())
+
+	p.upstream = newUpstreamDialer(func() []UpstreamRule {
+		return p.Policy().Upstream
+	})
+	p.direct = http.DefaultTransport.(*http.Transport).Clone()
+	p.direct.Proxy = p.environmentProxy
+	p.direct.DialContext = p.upstream.DialContext
+	p.http1, p.h2c = newProtocolTransports(p.direct)
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	proxyKeyPos := strings.Index(r.URL.Path, "/proxy/")
-	if proxyKeyPos == -1 {
-		http.Error(w, "invalid proxy path", http.StatusBadRequest)
+	done := p.track()
+	defer done()
+
+	if p.refuseNewSession(w, r) {
 		return
 	}
 
-	proxyUrl := r.URL.Path[proxyKeyPos+len("/proxy/"):]
-	if r.URL.RawQuery != "" {
-		proxyUrl += "?" + r.URL.RawQuery
+	policy := p.Policy()
+
+	proxyUrl, err := resolveTarget(r, policy.Targets, time.Now())
+	if err != nil {
+		p.writeError(w, r, err)
+		return
+	}
+
+	if limit := policy.Limits.MaxRequestBody; limit > 0 && r.ContentLength > limit {
+		p.writeError(w, r, &BodyTooLargeError{Direction: "request", Limit: limit})
+		return
 	}
 
 	req, err := http.NewRequestWithContext(r.Context(), r.Method, proxyUrl, r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		p.writeError(w, r, newProblem(http.StatusBadRequest, CodeInvalidTarget, "the target is not a valid URL"))
 		return
 	}
 
 	for key, header := range r.Header {
 		req.Header[key] = header
 	}
+	req.Header.Del(targetHeader)
+	forwardRequestBody(req, r)
+	if accept := upstreamAcceptEncodingFor(r); accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	} else {
+		req.Header.Del("Accept-Encoding")
+	}
 
-	session := p.getOrCreateSession(w, r)
+	grpc := grpcRequestMode(r)
+	if (grpc == grpcWeb || grpc == grpcWebText) && !policy.GRPC.Web {
+		grpc = grpcNone
+	}
+	if grpc == grpcWeb || grpc == grpcWebText {
+		translateGRPCWebRequest(req, grpc)
+	}
+
+	ctx, timer := withPhaseTimeouts(req.Context(), policy.Timeouts.forHost(req.URL.Host))
+	defer timer.close()
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok && grpc != grpcNone {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, &DeadlineError{Timeout: timeout})
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+
+	session := p.getOrCreateSession(w, r, policy.Session)
+
+	if err := p.checkRateLimits(w, r, policy.RateLimits, session); err != nil {
+		p.logger.Warn("request rate limited", "host", req.URL.Host, "error", err)
+		p.writeError(w, r, err)
+		return
+	}
+
+	req = req.WithContext(withSession(req.Context(), session))
 
-	p.mu.RLock()
-	jar := p.cookieJars[session]
-	p.mu.RUnlock()
+	vars := headerVars(r, req, session)
 
-	if jar == nil {
-		newJar, _ := cookiejar.New(&cookiejar.Options{})
-		p.mu.Lock()
-		if p.cookieJars[session] == nil {
-			p.cookieJars[session] = newJar
-			jar = newJar
-		} else {
-			jar = p.cookieJars[session]
+	for _, modify := range p.requestModifiers {
+		if err := modify(req); err != nil {
+			p.writeError(w, r, err)
+			return
 		}
-		p.mu.Unlock()
+	}
+
+	checkRedirect := p.cli.CheckRedirect
+	if checkRedirect == nil {
+		checkRedirect = checkRedirectLimit
 	}
 
 	sessionClient := &http.Client{
-		Transport:     p.cli.Transport,
-		Jar:           jar,
-		CheckRedirect: p.cli.CheckRedirect,
+		Transport:     &headerTransport{base: p.transport(policy), rules: policy.Headers, vars: vars},
+		Jar:           p.sessions.Jar(session),
+		CheckRedirect: checkRedirect,
 		Timeout:       p.cli.Timeout,
 	}
 
 	resp, err := sessionClient.Do(req)
 	if err != nil {
-		http.Error(w, err.Error(), statusForUpstreamError(err))
+		err = deadlineErr(ctx, timer.err(err))
+		p.logger.Warn("upstream request failed", "host", req.URL.Host, "error", err)
+		p.writeError(w, r, err)
 		return
 	}
 
 	defer resp.Body.Close()
+	resp.Body = timer.watchBody(newResumableBody(sessionClient, resp, policy.Resume))
+
+	policy.Headers.ApplyResponse(resp, vars.forRequest(resp.Request))
+
+	upstreamBody := resp.Body
+	for _, modify := range p.responseModifiers {
+		if err := modify(resp); err != nil {
+			resp.Body.Close()
+			p.writeError(w, r, err)
+			return
+		}
+	}
+	if resp.Body != upstreamBody {
+		defer resp.Body.Close()
+	}
+
+	if grpc == grpcWeb || grpc == grpcWebText {
+		copyResponseHeaders(w, resp)
+		streamGRPCWebResponse(w, resp, grpc)
+		return
+	}
+
+	if streamingResponse(resp) {
+		if err := decodeStreamForClient(r, resp, policy.Limits.decodedLimit()); err != nil {
+			p.writeError(w, r, &BodyReadError{Err: err})
+			return
+		}
+		defer resp.Body.Close()
+		copyResponseHeaders(w, resp)
+		streamResponse(w, resp)
+		return
+	}
+
+	transformed, err := applyTransforms(resp, slices.Concat(p.transforms, policy.Transforms), policy.Limits.decodedLimit())
+	if err != nil {
+		p.writeError(w, r, &BodyReadError{Err: err})
+		return
+	}
+	if transformed {
+		defer resp.Body.Close()
+	}
+
+	raw := bufio.NewReaderSize(resp.Body, maxBufferedResponse)
+	if _, err := raw.Peek(maxBufferedResponse); err != nil && err != io.EOF {
+		p.writeError(w, r, &BodyReadError{Err: deadlineErr(ctx, timer.err(err))})
+		return
+	}
+
+	upstream := io.NopCloser(raw)
+	decoded, encoding, err := negotiateEncodingStream(r, resp, upstream, raw.Buffered(), policy)
+	if err != nil {
+		p.writeError(w, r, &BodyReadError{Err: err})
+		return
+	}
+	defer decoded.Close()
+
+	buffered := raw
+	if decoded != upstream {
+		buffered = bufio.NewReaderSize(decoded, maxBufferedResponse)
+		if _, err := buffered.Peek(maxBufferedResponse); err != nil && err != io.EOF {
+			p.writeError(w, r, &BodyReadError{Err: deadlineErr(ctx, timer.err(err))})
+			return
+		}
+	}
+	if buffered.Buffered() >= maxBufferedResponse {
+		streamLargeResponse(w, resp, buffered, encoding)
+		return
+	}
+
+	body, err := io.ReadAll(buffered)
+	if err != nil {
+		p.writeError(w, r, &BodyReadError{Err: deadlineErr(ctx, timer.err(err))})
+		return
+	}
+	if encoding != "" {
+		if body, err = encodeBody(encoding, body); err != nil {
+			p.writeError(w, r, &BodyReadError{Err: err})
+			return
+		}
+	}
+	if transformed || encoding != "" || decoded != upstream {
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	copyResponseHeaders(w, resp)
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+	copyTrailers(w, resp.Trailer)
+}
+
+// streamLargeResponse sends a body too large to buffer. Once the status is
+// written, a read error such as an exceeded limit can only abort the response.
+func streamLargeResponse(w http.ResponseWriter, resp *http.Response, body io.Reader, encoding string) {
+	copyResponseHeaders(w, resp)
+	w.WriteHeader(resp.StatusCode)
+
+	if encoding == "" {
+		copyBody(w, w, body)
+		copyTrailers(w, resp.Trailer)
+		return
+	}
 
+	encoder, err := newEncoder(encoding, w)
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	copyBody(w, encoder, body)
+	if err := encoder.Close(); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	copyTrailers(w, resp.Trailer)
+}
+
+func copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 	for key, headers := range resp.Header {
 		if strings.EqualFold(key, "Set-Cookie") {
 			continue
@@ -92,44 +296,111 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(key, header)
 		}
 	}
+}
+
+func (p *Proxy) transport(policy *Policy) http.RoundTripper {
+	base := p.cli.Transport
+	if base == nil {
+		base = &protocolTransport{direct: p.direct, http1: p.http1, h2c: p.h2c, settings: policy.HTTP2}
+		base = &forwardTransport{base: base, upstream: p.upstream}
+	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if p.breakers != nil {
+		base = &breakerTransport{base: base, breakers: p.breakers}
 	}
 
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+	fetch := base
+
+	base = &concurrencyTransport{base: base, limiter: p.queues, limits: policy.Concurrency}
+	base = &rateLimitTransport{base: base, limiter: p.limiter, limits: policy.RateLimits}
+
+	base = &contentTransport{base: base, limits: policy.Limits, contentTypes: policy.ContentTypes}
+	base = &politenessTransport{base: base, fetch: fetch, crawler: p.crawler, settings: policy.Politeness}
+
+	return &policyTransport{base: base, hosts: policy.Hosts}
+}
+
+func (p *Proxy) environmentProxy(req *http.Request) (*url.URL, error) {
+	if route, ok := forwardProxy(req); ok {
+		return route, nil
+	}
+	if len(p.Policy().Upstream) > 0 {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// BreakerHandler serves the state of each host's circuit breaker as JSON.
+func (p *Proxy) BreakerHandler() http.Handler {
+	if p.breakers == nil {
+		return newBreakerSet(BreakerConfig{})
+	}
+	return p.breakers
+}
+
+// QueueHandler serves the in-flight and queued requests of each upstream host
+// as JSON.
+func (p *Proxy) QueueHandler() http.Handler {
+	return p.queues
+}
+
+type sessionKey struct{}
+
+func withSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
 }
 
-func (p *Proxy) getOrCreateSession(w http.ResponseWriter, r *http.Request) string {
-	if cookie, err := r.Cookie(proxySessionCookie); err == nil {
+func sessionFromContext(ctx context.Context) string {
+	session, _ := ctx.Value(sessionKey{}).(string)
+	return session
+}
+
+// refuseNewSession answers 503 to a request without a session while the
+// proxy drains.
+func (p *Proxy) refuseNewSession(w http.ResponseWriter, r *http.Request) bool {
+	if !p.Draining() {
+		return false
+	}
+	if _, err := r.Cookie(proxySessionCookie); err == nil {
+		return false
+	}
+
+	w.Header().Set("Connection", "close")
+	p.writeError(w, r, newProblem(http.StatusServiceUnavailable, CodeDraining, "new sessions are not accepted while the proxy shuts down"))
+	return true
+}
+
+func (p *Proxy) getOrCreateSession(w http.ResponseWriter, r *http.Request, settings SessionPolicy) string {
+	if p.sessionResolver != nil {
+		if session := p.sessionResolver(w, r); session != "" {
+			return session
+		}
+	}
+
+	principal := PrincipalFromContext(r.Context())
+
+	if cookie, err := r.Cookie(proxySessionCookie); err == nil && p.claimSession(cookie.Value, principal) {
 		return cookie.Value
 	}
 
 	sessionID := fmt.Sprintf("%d", rand.Uint64())
+	p.claimSession(sessionID, principal)
 	http.SetCookie(w, &http.Cookie{
 		Name:     proxySessionCookie,
 		Value:    sessionID,
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   settings.Secure,
 		SameSite: http.SameSiteStrictMode,
-		MaxAge:   3600,
+		MaxAge:   int(settings.MaxAge.Seconds()),
 	})
 
 	return sessionID
 }
 
-func statusForUpstreamError(err error) int {
-	if errors.Is(err, context.DeadlineExceeded) {
-		return http.StatusGatewayTimeout
-	}
-
-	var netErr net.Error
-	if errors.As(err, &netErr) && netErr.Timeout() {
-		return http.StatusGatewayTimeout
+func (p *Proxy) claimSession(session string, principal *Principal) bool {
+	if principal == nil {
+		return true
 	}
 
-	return http.StatusBadGateway
+	return p.sessions.Claim(session, principal.Name)
 }
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"fmt"
@@ -445,9 +445,7 @@ func TestProxyMemoryLeakManySessions(t *testing.T) {
 			}
 		}
 
-		proxy.mu.RLock()
-		cookieJarCount := len(proxy.cookieJars)
-		proxy.mu.RUnlock()
+		cookieJarCount := proxy.sessions.(*MemorySessionStore).Len()
 
 		if cookieJarCount != numSessions {
 			t.Errorf("expected %d cookie jars, got %d", numSessions, cookieJarCount)
@@ -476,9 +474,7 @@ func TestProxyMemoryLeakManySessions(t *testing.T) {
 			}
 		}
 
-		proxy.mu.RLock()
-		finalCookieJarCount := len(proxy.cookieJars)
-		proxy.mu.RUnlock()
+		finalCookieJarCount := proxy.sessions.(*MemorySessionStore).Len()
 
 		if finalCookieJarCount != numSessions {
 			t.Errorf("after reuse: expected %d cookie jars, got %d", numSessions, finalCookieJarCount)
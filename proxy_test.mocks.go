@@ -1,10 +1,16 @@
-package main
+package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 )
 
 const mockExpectedResponseBody = "<>expected response body</>"
@@ -92,3 +98,171 @@ func mockNestedRedirectService() *httptest.Server {
 
 	return finalServer
 }
+
+type mockUpstreamProxy struct {
+	listener  net.Listener
+	tunnels   atomic.Int64
+	forwarded atomic.Int64
+	user      string
+	password  string
+}
+
+func (m *mockUpstreamProxy) URL(scheme string) string {
+	u := &url.URL{Scheme: scheme, Host: m.listener.Addr().String()}
+	if m.user != "" {
+		u.User = url.UserPassword(m.user, m.password)
+	}
+	return u.String()
+}
+
+func (m *mockUpstreamProxy) Close() {
+	m.listener.Close()
+}
+
+func (m *mockUpstreamProxy) serve(handshake func(net.Conn) (string, error)) {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			addr, err := handshake(conn)
+			if err != nil {
+				return
+			}
+
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+
+			m.tunnels.Add(1)
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+func newMockUpstreamProxy(user, password string) *mockUpstreamProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	return &mockUpstreamProxy{listener: ln, user: user, password: password}
+}
+
+func mockConnectProxy(user, password string) *mockUpstreamProxy {
+	m := newMockUpstreamProxy(user, password)
+
+	go m.serve(func(conn net.Conn) (string, error) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return "", err
+		}
+
+		if m.user != "" {
+			expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(m.user+":"+m.password))
+			if req.Header.Get("Proxy-Authorization") != expected {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				return "", errors.New("bad proxy credentials")
+			}
+		}
+
+		if req.Method != http.MethodConnect {
+			return "", m.forward(conn, req)
+		}
+
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		return req.Host, err
+	})
+
+	return m
+}
+
+var errMockForwarded = errors.New("request forwarded")
+
+func (m *mockUpstreamProxy) forward(conn net.Conn, req *http.Request) error {
+	if !req.URL.IsAbs() {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return errors.New("not an absolute-form request")
+	}
+
+	target, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Set("Connection", "close")
+	if err := req.Write(target); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(target), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	m.forwarded.Add(1)
+	resp.Close = true
+	if err := resp.Write(conn); err != nil {
+		return err
+	}
+	return errMockForwarded
+}
+
+func mockSOCKS5Proxy(user, password string) *mockUpstreamProxy {
+	m := newMockUpstreamProxy(user, password)
+
+	go m.serve(func(conn net.Conn) (string, error) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return "", err
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return "", err
+		}
+
+		if m.user == "" {
+			conn.Write([]byte{0x05, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x02})
+
+			auth := make([]byte, 2)
+			io.ReadFull(conn, auth)
+			username := make([]byte, auth[1])
+			io.ReadFull(conn, username)
+			passLen := make([]byte, 1)
+			io.ReadFull(conn, passLen)
+			pass := make([]byte, passLen[0])
+			io.ReadFull(conn, pass)
+
+			if string(username) != m.user || string(pass) != m.password {
+				conn.Write([]byte{0x01, 0x01})
+				return "", errors.New("bad socks credentials")
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		request := make([]byte, 3)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return "", err
+		}
+		addr, err := readSocksAddr(conn)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return addr, err
+	})
+
+	return m
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ResumePolicy resumes an interrupted response body with a Range request, up
+// to MaxAttempts times, when the upstream supports ranges and a validator.
+type ResumePolicy struct {
+	Enabled     bool `json:"enabled"`
+	MaxAttempts int  `json:"max_attempts,omitempty"`
+}
+
+const defaultResumeAttempts = 3
+
+func multipartByteranges(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "multipart/byteranges"
+}
+
+func parseContentRange(value string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+
+	span, _, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+
+	return start, end, true
+}
+
+func resumeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+type resumableBody struct {
+	body      io.ReadCloser
+	client    *http.Client
+	req       *http.Request
+	validator string
+	encoding  string
+	offset    int64
+	end       int64
+	attempts  int
+}
+
+func newResumableBody(client *http.Client, resp *http.Response, policy ResumePolicy) io.ReadCloser {
+	req := resp.Request
+	if !policy.Enabled || req == nil || req.Method != http.MethodGet || resp.Uncompressed || multipartByteranges(resp) {
+		return resp.Body
+	}
+
+	validator := resumeValidator(resp)
+	if validator == "" {
+		return resp.Body
+	}
+
+	b := &resumableBody{
+		body:      resp.Body,
+		client:    client,
+		req:       req,
+		validator: validator,
+		encoding:  resp.Header.Get("Content-Encoding"),
+		end:       -1,
+		attempts:  policy.MaxAttempts,
+	}
+	if b.attempts <= 0 {
+		b.attempts = defaultResumeAttempts
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.Header.Get("Accept-Ranges") != "bytes" {
+			return resp.Body
+		}
+	case http.StatusPartialContent:
+		start, end, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok {
+			return resp.Body
+		}
+		b.offset, b.end = start, end
+	default:
+		return resp.Body
+	}
+
+	return b
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || err == io.EOF || b.attempts == 0 || b.req.Context().Err() != nil {
+			return n, err
+		}
+
+		b.attempts--
+		if !b.reopen() {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (b *resumableBody) reopen() bool {
+	span := fmt.Sprintf("bytes=%d-", b.offset)
+	if b.end >= 0 {
+		span += strconv.FormatInt(b.end, 10)
+	}
+
+	req := b.req.Clone(b.req.Context())
+	req.Header.Set("Range", span)
+	req.Header.Set("If-Range", b.validator)
+
+	b.body.Close()
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false
+	}
+
+	start, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || start != b.offset || resumeValidator(resp) != b.validator ||
+		resp.Uncompressed || resp.Header.Get("Content-Encoding") != b.encoding {
+		resp.Body.Close()
+		return false
+	}
+
+	b.body = resp.Body
+	return true
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var rangeContent = strings.Repeat("0123456789", 1000)
+
+func rangeService(t *testing.T, drops int32, etags ...string) *httptest.Server {
+	t.Helper()
+
+	var dropped, served atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"v1"`
+		if n := int(served.Add(1)) - 1; n < len(etags) {
+			etag = etags[n]
+		}
+		w.Header().Set("ETag", etag)
+
+		if dropped.Load() < drops {
+			dropped.Add(1)
+
+			start, end := 0, len(rangeContent)-1
+			if r.Header.Get("Range") != "" {
+				spec := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+				first, last, _ := strings.Cut(spec, "-")
+				start, _ = strconv.Atoi(first)
+				if last != "" {
+					end, _ = strconv.Atoi(last)
+				}
+				w.Header().Set("Content-Range", "bytes "+first+"-"+strconv.Itoa(end)+"/"+strconv.Itoa(len(rangeContent)))
+				w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+				w.WriteHeader(http.StatusPartialContent)
+			} else {
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", strconv.Itoa(len(rangeContent)))
+			}
+
+			w.Write([]byte(rangeContent[start : start+(end-start+1)/2]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		http.ServeContent(w, r, "data.txt", time.Time{}, strings.NewReader(rangeContent))
+	}))
+	t.Cleanup(service.Close)
+
+	return service
+}
+
+func TestProxyRangePassThrough(t *testing.T) {
+	service := rangeService(t, 0)
+	proxy := NewProxy(&http.Client{})
+
+	testCases := []struct {
+		name        string
+		headers     map[string]string
+		status      int
+		body        string
+		contentType string
+	}{
+		{
+			name:    "single range",
+			headers: map[string]string{"Range": "bytes=10-19"},
+			status:  http.StatusPartialContent,
+			body:    rangeContent[10:20],
+		},
+		{
+			name:    "if-range match",
+			headers: map[string]string{"Range": "bytes=5-", "If-Range": `"v1"`},
+			status:  http.StatusPartialContent,
+			body:    rangeContent[5:],
+		},
+		{
+			name:    "if-range mismatch",
+			headers: map[string]string{"Range": "bytes=5-", "If-Range": `"v0"`},
+			status:  http.StatusOK,
+			body:    rangeContent,
+		},
+		{
+			name:        "multiple ranges",
+			headers:     map[string]string{"Range": "bytes=0-1,10-11"},
+			status:      http.StatusPartialContent,
+			contentType: "multipart/byteranges",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+			for key, value := range tc.headers {
+				r.Header.Set(key, value)
+			}
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d", tc.status, w.Code)
+			}
+			if tc.body != "" && w.buffer.String() != tc.body {
+				t.Errorf("expected %d byte body, got %d bytes", len(tc.body), w.buffer.Len())
+			}
+			if tc.contentType != "" && !strings.HasPrefix(w.Header().Get("Content-Type"), tc.contentType) {
+				t.Errorf("expected %s, got %s", tc.contentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestProxyResume(t *testing.T) {
+	testCases := []struct {
+		name        string
+		resume      ResumePolicy
+		maxInFlight int
+		drops       int32
+		etags       []string
+		rng         string
+		status      int
+		body        string
+	}{
+		{
+			name:   "resumes a full download",
+			resume: ResumePolicy{Enabled: true},
+			drops:  2,
+			status: http.StatusOK,
+			body:   rangeContent,
+		},
+		{
+			name:   "resumes a partial download",
+			resume: ResumePolicy{Enabled: true},
+			drops:  1,
+			rng:    "bytes=100-",
+			status: http.StatusPartialContent,
+			body:   rangeContent[100:],
+		},
+		{
+			name:        "resumes under a host limit of one",
+			resume:      ResumePolicy{Enabled: true},
+			maxInFlight: 1,
+			drops:       1,
+			status:      http.StatusOK,
+			body:        rangeContent,
+		},
+		{
+			name:   "resume disabled",
+			drops:  1,
+			status: http.StatusBadGateway,
+		},
+		{
+			name:   "validator changed",
+			resume: ResumePolicy{Enabled: true},
+			drops:  1,
+			etags:  []string{`"v1"`, `"v2"`},
+			status: http.StatusBadGateway,
+		},
+		{
+			name:   "attempts exhausted",
+			resume: ResumePolicy{Enabled: true, MaxAttempts: 1},
+			drops:  3,
+			status: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := rangeService(t, tc.drops, tc.etags...)
+
+			policy := DefaultPolicy()
+			policy.Resume = tc.resume
+			policy.Concurrency.MaxInFlight = tc.maxInFlight
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/proxy/"+service.URL, nil)
+			if tc.rng != "" {
+				r.Header.Set("Range", tc.rng)
+			}
+
+			w := newMockResponseWriter()
+			func() {
+				defer func() {
+					if recover() != nil {
+						w.Code = http.StatusBadGateway
+					}
+				}()
+				proxy.ServeHTTP(w, r)
+			}()
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d", tc.status, w.Code)
+			}
+			if tc.body != "" && !bytes.Equal(w.buffer.Bytes(), []byte(tc.body)) {
+				t.Errorf("expected %d byte body, got %d bytes", len(tc.body), w.buffer.Len())
+			}
+		})
+	}
+}
+
+func TestProxyStreamsLargeResponses(t *testing.T) {
+	large := make([]byte, 3*maxBufferedResponse)
+	rand.New(rand.NewSource(1)).Read(large)
+	release := map[string]chan struct{}{"/plain": make(chan struct{}), "/gzip": make(chan struct{})}
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Writer(w)
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			body = gz
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+		}
+		body.Write(large[:2*maxBufferedResponse])
+		<-release[r.URL.Path]
+		body.Write(large[2*maxBufferedResponse:])
+	}))
+	defer service.Close()
+
+	front := httptest.NewServer(NewProxy(&http.Client{}))
+	defer front.Close()
+
+	testCases := []struct {
+		name          string
+		path          string
+		contentLength int64
+	}{
+		{"plain", "/plain", int64(len(large))},
+		{"decoded for the client", "/gzip", -1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}, Timeout: 10 * time.Second}
+
+			resp, err := client.Get(front.URL + "/proxy/" + service.URL + tc.path)
+			close(release[tc.path])
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.ContentLength != tc.contentLength || resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("expected length %d without encoding, got %d %q", tc.contentLength, resp.ContentLength, resp.Header.Get("Content-Encoding"))
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || !bytes.Equal(body, large) {
+				t.Errorf("expected %d byte body, got %d bytes, %v", len(large), len(body), err)
+			}
+		})
+	}
+}
+
+func TestResumeRequiresSameEncoding(t *testing.T) {
+	testCases := []struct {
+		name     string
+		encoding string
+		ok       bool
+	}{
+		{name: "same encoding", encoding: "gzip", ok: true},
+		{name: "encoding changed", encoding: "", ok: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("Range") == "" {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Header().Set("Accept-Ranges", "bytes")
+					w.Header().Set("Content-Length", strconv.Itoa(len(rangeContent)))
+					w.Write([]byte(rangeContent[:100]))
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				if tc.encoding != "" {
+					w.Header().Set("Content-Encoding", tc.encoding)
+				}
+				http.ServeContent(w, r, "data.txt", time.Time{}, strings.NewReader(rangeContent))
+			}))
+			defer service.Close()
+
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+			resp, err := client.Get(service.URL)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+
+			body := newResumableBody(client, resp, ResumePolicy{Enabled: true})
+			defer body.Close()
+
+			data, err := io.ReadAll(body)
+			if tc.ok && (err != nil || string(data) != rangeContent) {
+				t.Errorf("expected the full body, got %d bytes and %v", len(data), err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("expected the resume to be rejected, got %d bytes", len(data))
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	testCases := []struct {
+		value      string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes 0-99/1000", 0, 99, true},
+		{"bytes 100-199/*", 100, 199, true},
+		{"bytes */1000", 0, 0, false},
+		{"bytes 9-1/10", 0, 0, false},
+		{"items 0-1/2", 0, 0, false},
+	}
+
+	for _, tc := range testCases {
+		start, end, ok := parseContentRange(tc.value)
+		if start != tc.start || end != tc.end || ok != tc.ok {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v", tc.value, start, end, ok)
+		}
+	}
+}
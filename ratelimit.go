@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitScope is what a rate limit is counted per.
+type RateLimitScope string
+
+// Rate limit scopes.
+const (
+	ScopeClient    RateLimitScope = "client"
+	ScopeSession   RateLimitScope = "session"
+	ScopePrincipal RateLimitScope = "principal"
+	ScopeHost      RateLimitScope = "host"
+)
+
+// RateLimit is a token bucket: Rate requests per second with bursts of up to
+// Burst.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("rate must be positive and burst at least 1, got rate %v and burst %d", l.Rate, l.Burst)
+	}
+	return nil
+}
+
+// HostRateLimit overrides the host rate limit for hosts matching Host.
+type HostRateLimit struct {
+	Host string `json:"host"`
+	RateLimit
+}
+
+// RateLimits are the rate limits per client IP, session, principal and
+// upstream host. A nil limit is not enforced. Requests over a host limit wait
+// up to HostQueue for a token.
+type RateLimits struct {
+	Client        *RateLimit
+	Session       *RateLimit
+	Principal     *RateLimit
+	Host          *RateLimit
+	HostOverrides []HostRateLimit
+	HostQueue     time.Duration
+}
+
+func (l RateLimits) forHost(host string) *RateLimit {
+	for _, override := range l.HostOverrides {
+		if matchHost(override.Host, host) {
+			return &override.RateLimit
+		}
+	}
+	return l.Host
+}
+
+// RateLimitError is returned when a request goes over a rate limit.
+type RateLimitError struct {
+	Scope      RateLimitScope
+	RetryAfter time.Duration
+	decision   rateDecision
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit exceeded, retry after %s", e.Scope, e.RetryAfter.Round(time.Millisecond))
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+func (b *tokenBucket) refill(now time.Time, limit RateLimit) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	b.limit = limit
+}
+
+type rateDecision struct {
+	limit     RateLimit
+	allowed   bool
+	wait      time.Duration
+	remaining int
+	reset     time.Duration
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (l *rateLimiter) take(key string, limit RateLimit, maxWait time.Duration) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, limit)
+
+	d := rateDecision{limit: limit}
+
+	if b.tokens < 1 {
+		d.wait = seconds((1 - b.tokens) / limit.Rate)
+	}
+
+	if d.wait <= maxWait {
+		b.tokens--
+		d.allowed = true
+	}
+
+	d.remaining = int(math.Max(0, math.Floor(b.tokens)))
+	d.reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+
+	return d
+}
+
+func (l *rateLimiter) refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+1)
+	}
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func (p *Proxy) checkRateLimits(w http.ResponseWriter, r *http.Request, limits RateLimits, session string) error {
+	type check struct {
+		scope RateLimitScope
+		key   string
+		limit *RateLimit
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	checks := []check{
+		{ScopeClient, client, limits.Client},
+		{ScopeSession, session, limits.Session},
+	}
+	if principal := PrincipalFromContext(r.Context()); principal != nil {
+		checks = append(checks, check{ScopePrincipal, principal.Name, limits.Principal})
+	}
+
+	var taken []string
+	var tightest *rateDecision
+	for _, c := range checks {
+		if c.limit == nil {
+			continue
+		}
+
+		key := string(c.scope) + ":" + c.key
+		d := p.limiter.take(key, *c.limit, 0)
+		if !d.allowed {
+			for _, key := range taken {
+				p.limiter.refund(key)
+			}
+			return &RateLimitError{Scope: c.scope, RetryAfter: d.wait, decision: d}
+		}
+
+		taken = append(taken, key)
+		if tightest == nil || d.remaining < tightest.remaining {
+			tightest = &d
+		}
+	}
+
+	if tightest != nil {
+		setRateLimitHeaders(w, *tightest)
+	}
+
+	return nil
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, d rateDecision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	w.Header().Set("RateLimit-Reset", retryAfterSeconds(d.reset))
+}
+
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+	limits  RateLimits
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limit := t.limits.forHost(req.URL.Host)
+	if limit == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	key := string(ScopeHost) + ":" + req.URL.Host
+	d := t.limiter.take(key, *limit, t.limits.HostQueue)
+	if !d.allowed {
+		return nil, &RateLimitError{Scope: ScopeHost, RetryAfter: d.wait, decision: d}
+	}
+
+	if d.wait > 0 {
+		if err := sleepContext(req.Context(), d.wait); err != nil {
+			t.limiter.refund(key)
+			return nil, err
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
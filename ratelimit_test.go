@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter()
+	limiter.now = func() time.Time { return now }
+
+	limit := RateLimit{Rate: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if d := limiter.take("k", limit, 0); !d.allowed {
+			t.Fatalf("request %d: expected burst to be allowed", i)
+		}
+	}
+
+	d := limiter.take("k", limit, 0)
+	if d.allowed {
+		t.Fatal("expected request beyond burst to be rejected")
+	}
+	if d.wait != time.Second {
+		t.Errorf("expected wait of 1s, got %s", d.wait)
+	}
+	if d.remaining != 0 || d.reset != 2*time.Second {
+		t.Errorf("expected remaining 0 and reset 2s, got %d and %s", d.remaining, d.reset)
+	}
+
+	if d := limiter.take("k", limit, time.Second); !d.allowed || d.wait != time.Second {
+		t.Errorf("expected queued request to be allowed after 1s, got %+v", d)
+	}
+
+	now = now.Add(time.Hour)
+	if d := limiter.take("k", limit, 0); !d.allowed || d.remaining != 1 {
+		t.Errorf("expected bucket to refill, got %+v", d)
+	}
+
+	limiter.take("other", limit, 0)
+	now = now.Add(time.Hour)
+	limiter.take("k", limit, 0)
+	if _, ok := limiter.buckets["other"]; ok {
+		t.Error("expected full idle buckets to be swept")
+	}
+}
+
+func TestProxyRateLimits(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	testCases := []struct {
+		name   string
+		limits RateLimits
+		second func(r *http.Request, session *http.Cookie)
+		status int
+	}{
+		{
+			name:   "session limit rejects same session",
+			limits: RateLimits{Session: &RateLimit{Rate: 0.1, Burst: 1}},
+			second: func(r *http.Request, session *http.Cookie) { r.AddCookie(session) },
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "session limit allows other session",
+			limits: RateLimits{Session: &RateLimit{Rate: 0.1, Burst: 1}},
+			second: func(*http.Request, *http.Cookie) {},
+			status: http.StatusOK,
+		},
+		{
+			name:   "client limit spans sessions",
+			limits: RateLimits{Client: &RateLimit{Rate: 0.1, Burst: 1}},
+			second: func(*http.Request, *http.Cookie) {},
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "client limit keyed by address",
+			limits: RateLimits{Client: &RateLimit{Rate: 0.1, Burst: 1}},
+			second: func(r *http.Request, _ *http.Cookie) { r.RemoteAddr = "192.0.2.99:1234" },
+			status: http.StatusOK,
+		},
+		{
+			name:   "principal limit spans sessions",
+			limits: RateLimits{Principal: &RateLimit{Rate: 0.1, Burst: 1}},
+			second: func(*http.Request, *http.Cookie) {},
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "host limit",
+			limits: RateLimits{Host: &RateLimit{Rate: 0.1, Burst: 1}},
+			second: func(*http.Request, *http.Cookie) {},
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name: "host override",
+			limits: RateLimits{
+				Host:          &RateLimit{Rate: 0.1, Burst: 1},
+				HostOverrides: []HostRateLimit{{Host: "127.0.0.1", RateLimit: RateLimit{Rate: 100, Burst: 10}}},
+			},
+			second: func(*http.Request, *http.Cookie) {},
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.RateLimits = tc.limits
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			request := func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+				return r.WithContext(WithPrincipal(r.Context(), &Principal{Name: "alice"}))
+			}
+
+			w1 := newMockResponseWriter()
+			proxy.ServeHTTP(w1, request())
+			if w1.Code != http.StatusOK {
+				t.Fatalf("expected first request to succeed, got %d: %s", w1.Code, w1.buffer.String())
+			}
+
+			r := request()
+			tc.second(r, extractSessionCookie(w1.ResponseRecorder))
+			w2 := newMockResponseWriter()
+			proxy.ServeHTTP(w2, r)
+
+			if w2.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w2.Code, w2.buffer.String())
+			}
+			if tc.status == http.StatusTooManyRequests && w2.Header().Get("Retry-After") == "" {
+				t.Error("expected Retry-After on rate limited response")
+			}
+		})
+	}
+}
+
+func TestProxyRateLimitHeaders(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.RateLimits = RateLimits{
+		Client:  &RateLimit{Rate: 1, Burst: 5},
+		Session: &RateLimit{Rate: 1, Burst: 3},
+	}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+	expected := map[string]string{
+		"RateLimit-Limit":     "3",
+		"RateLimit-Remaining": "2",
+		"RateLimit-Reset":     "1",
+	}
+	for header, value := range expected {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("expected %s %q, got %q", header, value, got)
+		}
+	}
+}
+
+func TestProxyRateLimitHeadersOnRejection(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	testCases := []struct {
+		name   string
+		limits RateLimits
+	}{
+		{"session scope", RateLimits{Session: &RateLimit{Rate: 0.1, Burst: 1}}},
+		{"host scope", RateLimits{Host: &RateLimit{Rate: 0.1, Burst: 1}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.RateLimits = tc.limits
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			var w *mockResponseWriter
+			for range 2 {
+				w = newMockResponseWriter()
+				r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+				r.AddCookie(&http.Cookie{Name: proxySessionCookie, Value: "s1"})
+				proxy.ServeHTTP(w, r)
+			}
+
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+			}
+			expected := map[string]string{
+				"RateLimit-Limit":     "1",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "10",
+				"Retry-After":         "10",
+			}
+			for header, value := range expected {
+				if got := w.Header().Get(header); got != value {
+					t.Errorf("expected %s %q, got %q", header, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyRateLimitRefundsOnRejection(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.RateLimits = RateLimits{
+		Client:    &RateLimit{Rate: 0.1, Burst: 2},
+		Principal: &RateLimit{Rate: 0.1, Burst: 1},
+	}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	testCases := []struct {
+		principal string
+		status    int
+	}{
+		{"alice", http.StatusOK},
+		{"alice", http.StatusTooManyRequests},
+		{"bob", http.StatusOK},
+	}
+
+	for i, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+		r = r.WithContext(WithPrincipal(r.Context(), &Principal{Name: tc.principal}))
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("request %d: expected status code %d, got %d", i, tc.status, w.Code)
+		}
+	}
+}
+
+func TestProxyHostRateLimitQueue(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	policy.RateLimits = RateLimits{
+		Host:      &RateLimit{Rate: 10, Burst: 1},
+		HostQueue: time.Second,
+	}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected queued request to succeed, got %d: %s", i, w.Code, w.buffer.String())
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected requests to be spaced by the host rate, took %s", elapsed)
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type activeSet struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (a *activeSet) add() func() {
+	a.mu.Lock()
+	if a.n == 0 {
+		a.idle = make(chan struct{})
+	}
+	a.n++
+	a.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			a.n--
+			if a.n == 0 {
+				close(a.idle)
+			}
+			a.mu.Unlock()
+		})
+	}
+}
+
+func (a *activeSet) wait(ctx context.Context) error {
+	a.mu.Lock()
+	if a.n == 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	idle := a.idle
+	a.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type tunnelSet struct {
+	active activeSet
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+}
+
+func (t *tunnelSet) add(conn net.Conn) func() {
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+
+	done := t.active.add()
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		done()
+	}
+}
+
+func (t *tunnelSet) wait(ctx context.Context) error {
+	return t.active.wait(ctx)
+}
+
+func (t *tunnelSet) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+func (p *Proxy) track() func() {
+	return p.active.add()
+}
+
+func (p *Proxy) trackTunnel(conn net.Conn) func() {
+	return p.tunnels.add(conn)
+}
+
+// StartDrain stops the proxy from accepting new sessions and fails its
+// readiness check. Requests in existing sessions are still served.
+func (p *Proxy) StartDrain() {
+	p.draining.Store(true)
+}
+
+// Draining reports whether StartDrain was called.
+func (p *Proxy) Draining() bool {
+	return p.draining.Load()
+}
+
+// OnDrained registers a hook that Drain runs once requests and tunnels are
+// done, for example to save session state.
+func (p *Proxy) OnDrained(hook func(context.Context) error) {
+	p.mu.Lock()
+	p.drainHooks = append(p.drainHooks, hook)
+	p.mu.Unlock()
+}
+
+// Drain waits for in-flight requests and tunnels, closing the tunnels still
+// open when ctx is done, and then runs the OnDrained hooks.
+func (p *Proxy) Drain(ctx context.Context) error {
+	p.StartDrain()
+
+	err := p.active.wait(ctx)
+	if err == nil {
+		err = p.tunnels.wait(ctx)
+	}
+	if err != nil {
+		p.tunnels.close()
+	}
+
+	p.mu.RLock()
+	hooks := append([]func(context.Context) error(nil), p.drainHooks...)
+	p.mu.RUnlock()
+
+	errs := []error{err}
+	for _, hook := range hooks {
+		errs = append(errs, hook(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ReadyHandler serves a readiness check that fails with 503 while the proxy
+// drains.
+func (p *Proxy) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.Draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// DrainConfig sets how RunServer shuts down: how long the proxy reports not
+// ready before it stops accepting connections, and how long it then waits for
+// requests to finish.
+type DrainConfig struct {
+	ReadinessGrace time.Duration
+	Timeout        time.Duration
+}
+
+// RunServer serves srv on lns until ctx is done, then marks the proxy as
+// draining, waits drain.ReadinessGrace, and shuts down within drain.Timeout.
+// Connections upgraded to h2c get a GOAWAY and are closed at the deadline.
+func RunServer(ctx context.Context, srv *http.Server, proxy *Proxy, drain DrainConfig, lns ...net.Listener) error {
+	errCh := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() {
+			errCh <- srv.Serve(ln)
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	proxy.StartDrain()
+
+	if drain.ReadinessGrace > 0 {
+		time.Sleep(drain.ReadinessGrace)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain.Timeout)
+	defer cancel()
+
+	upgraded := &tunnelSet{}
+	if h, ok := srv.Handler.(*h2cUpgradeHandler); ok {
+		upgraded = &h.tunnels
+	}
+
+	err := srv.Shutdown(shutdownCtx)
+	if err == nil {
+		err = upgraded.wait(shutdownCtx)
+	}
+	if err != nil {
+		srv.Close()
+		upgraded.close()
+	}
+
+	if drainErr := proxy.Drain(shutdownCtx); err == nil {
+		err = drainErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for range lns {
+		if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/http2"
+)
+
+func TestProxyDrainingSessions(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{})
+	proxy.StartDrain()
+
+	t.Run("refuses new sessions", func(t *testing.T) {
+		w := newMockResponseWriter()
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+		proxy.ServeHTTP(w, r)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+		if extractSessionCookie(w.ResponseRecorder) != nil {
+			t.Error("expected no session cookie while draining")
+		}
+	})
+
+	t.Run("serves existing sessions", func(t *testing.T) {
+		w := newMockResponseWriter()
+		r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+		r.AddCookie(&http.Cookie{Name: proxySessionCookie, Value: "existing"})
+		proxy.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("batch refuses new sessions", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`[{"url": "`+service.URL+`"}]`))
+		proxy.BatchHandler().ServeHTTP(w, r)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+		if extractSessionCookie(w) != nil {
+			t.Error("expected no session cookie while draining")
+		}
+	})
+
+	t.Run("readiness fails", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		proxy.ReadyHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	})
+}
+
+func TestRunServerGracefulShutdown(t *testing.T) {
+	upstreamStarted := make(chan struct{})
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(upstreamStarted)
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("slow response"))
+		}),
+	)
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{})
+
+	flushed := false
+	proxy.OnDrained(func(context.Context) error {
+		flushed = true
+		return nil
+	})
+
+	router := chi.NewRouter()
+	router.Handle("/proxy/*", proxy)
+	router.Handle("/readyz", proxy.ReadyHandler())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := "http://" + ln.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- RunServer(ctx, &http.Server{Handler: router}, proxy, DrainConfig{
+			ReadinessGrace: 100 * time.Millisecond,
+			Timeout:        5 * time.Second,
+		}, ln)
+	}()
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(addr + "/proxy/" + service.URL)
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inflight <- result{code: resp.StatusCode, body: string(body), err: err}
+	}()
+
+	<-upstreamStarted
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+
+	resp, err := http.Get(addr + "/readyz")
+	if err != nil {
+		t.Fatalf("readiness request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness status %d during drain, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	res := <-inflight
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.code != http.StatusOK || res.body != "slow response" {
+		t.Errorf("expected in-flight request to complete, got %d %q", res.code, res.body)
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+	if !flushed {
+		t.Error("expected drain hooks to run on shutdown")
+	}
+}
+
+func TestProxyDrainClosesTunnels(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	proxy := NewProxy(&http.Client{})
+	addr := startSOCKSServer(t, proxy, nil, false)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if err := socks5Connect(conn, nil, echo.Addr().String()); err != nil {
+		t.Fatalf("socks connect failed: %v", err)
+	}
+
+	flushed := false
+	proxy.OnDrained(func(context.Context) error {
+		flushed = true
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := proxy.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the open tunnel to hold the drain until the deadline, got %v", err)
+	}
+	if !flushed {
+		t.Error("expected drain hooks to run after the deadline")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the tunnel to be closed, got %v", err)
+	}
+}
+
+func TestRunServerUpgradedConnections(t *testing.T) {
+	proxy := NewProxy(&http.Client{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- RunServer(ctx, NewServer(protoHandler(), HTTP2Config{H2C: true}), proxy, DrainConfig{Timeout: 5 * time.Second}, ln)
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %v %v", resp, err)
+	}
+
+	io.WriteString(conn, http2.ClientPreface)
+	framer := http2.NewFramer(conn, br)
+	framer.WriteSettings()
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if frame.Header().StreamID == 1 && frame.Header().Flags.Has(http2.FlagDataEndStream) {
+			break
+		}
+	}
+
+	cancel()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	goAway := false
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			break
+		}
+		if f, ok := frame.(*http2.GoAwayFrame); ok && f.ErrCode == http2.ErrCodeNo {
+			goAway = true
+		}
+	}
+	if !goAway {
+		t.Error("expected a GOAWAY on the upgraded connection")
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SessionStore holds the cookie jar and owner of each session. Claim binds a
+// session to a principal on first use and reports whether principal owns it.
+type SessionStore interface {
+	Jar(session string) http.CookieJar
+	Claim(session, principal string) bool
+}
+
+// MemorySessionStore is a SessionStore kept in memory. Save and
+// LoadMemorySessionStore carry it across restarts.
+type MemorySessionStore struct {
+	mu     sync.RWMutex
+	jars   map[string]*recordingJar
+	owners map[string]string
+}
+
+// NewMemorySessionStore returns an empty store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		jars:   make(map[string]*recordingJar),
+		owners: make(map[string]string),
+	}
+}
+
+// Jar returns the cookie jar of session, creating it on first use.
+func (s *MemorySessionStore) Jar(session string) http.CookieJar {
+	s.mu.RLock()
+	jar := s.jars[session]
+	s.mu.RUnlock()
+
+	if jar != nil {
+		return jar
+	}
+
+	newJar := newRecordingJar()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.jars[session] == nil {
+		s.jars[session] = newJar
+	}
+
+	return s.jars[session]
+}
+
+// Claim gives session to principal if it has no owner yet, and reports
+// whether principal owns it.
+func (s *MemorySessionStore) Claim(session, principal string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owner, ok := s.owners[session]
+	if !ok {
+		s.owners[session] = principal
+		return true
+	}
+
+	return owner == principal
+}
+
+// Len returns the number of sessions with a cookie jar.
+func (s *MemorySessionStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.jars)
+}
+
+type savedSession struct {
+	Owner   *string       `json:"owner,omitempty"`
+	Cookies []savedCookie `json:"cookies,omitempty"`
+}
+
+type savedCookie struct {
+	URL      string        `json:"url"`
+	Name     string        `json:"name"`
+	Value    string        `json:"value"`
+	Path     string        `json:"path,omitempty"`
+	Domain   string        `json:"domain,omitempty"`
+	Expires  time.Time     `json:"expires,omitzero"`
+	Secure   bool          `json:"secure,omitempty"`
+	HttpOnly bool          `json:"http_only,omitempty"`
+	SameSite http.SameSite `json:"same_site,omitempty"`
+}
+
+// Save writes the cookies and owners of every session to path, replacing the
+// file atomically. Session cookies without an expiry are saved as well.
+func (s *MemorySessionStore) Save(path string) error {
+	s.mu.RLock()
+	sessions := make(map[string]*savedSession, len(s.jars))
+	for id, jar := range s.jars {
+		sessions[id] = &savedSession{Cookies: jar.saved(time.Now())}
+	}
+	for id, owner := range s.owners {
+		if sessions[id] == nil {
+			sessions[id] = &savedSession{}
+		}
+		sessions[id].Owner = &owner
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadMemorySessionStore returns a store with the sessions saved at path. A
+// missing file gives an empty store.
+func LoadMemorySessionStore(path string) (*MemorySessionStore, error) {
+	store := NewMemorySessionStore()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions map[string]savedSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for id, session := range sessions {
+		if session.Owner != nil {
+			store.owners[id] = *session.Owner
+		}
+		if len(session.Cookies) == 0 {
+			continue
+		}
+
+		jar := newRecordingJar()
+		for _, c := range session.Cookies {
+			u, err := url.Parse(c.URL)
+			if err != nil || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+				continue
+			}
+			jar.SetCookies(u, []*http.Cookie{{
+				Name:     c.Name,
+				Value:    c.Value,
+				Path:     c.Path,
+				Domain:   c.Domain,
+				Expires:  c.Expires,
+				Secure:   c.Secure,
+				HttpOnly: c.HttpOnly,
+				SameSite: c.SameSite,
+			}})
+		}
+		store.jars[id] = jar
+	}
+
+	return store, nil
+}
+
+// recordingJar is a cookiejar.Jar that remembers what was stored in it, since
+// the jar itself cannot list its cookies for saving.
+type recordingJar struct {
+	*cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]savedCookie
+}
+
+func newRecordingJar() *recordingJar {
+	jar, _ := cookiejar.New(&cookiejar.Options{})
+	return &recordingJar{Jar: jar, cookies: make(map[string]savedCookie)}
+}
+
+func (j *recordingJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, c := range cookies {
+		key := u.Scheme + "://" + u.Host + "\x00" + c.Domain + "\x00" + c.Path + "\x00" + c.Name
+		if c.Path == "" {
+			key += "\x00" + u.Path
+		}
+
+		expires := c.Expires
+		switch {
+		case c.MaxAge < 0:
+			delete(j.cookies, key)
+			continue
+		case c.MaxAge > 0:
+			expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		}
+		if !expires.IsZero() && !expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+
+		j.cookies[key] = savedCookie{
+			URL:      (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String(),
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Expires:  expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+			SameSite: c.SameSite,
+		}
+	}
+}
+
+func (j *recordingJar) saved(now time.Time) []savedCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	cookies := make([]savedCookie, 0, len(j.cookies))
+	for key, c := range j.cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies
+}
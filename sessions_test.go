@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+
+	u, _ := url.Parse("https://example.com/")
+	store.Jar("a").SetCookies(u, []*http.Cookie{{Name: "id", Value: "1"}})
+
+	if len(store.Jar("a").Cookies(u)) != 1 {
+		t.Errorf("expected the same jar for the same session")
+	}
+	if len(store.Jar("b").Cookies(u)) != 0 {
+		t.Errorf("expected a separate jar for another session")
+	}
+	if store.Len() != 2 {
+		t.Errorf("expected 2 jars, got %d", store.Len())
+	}
+
+	testCases := []struct {
+		name      string
+		session   string
+		principal string
+		expect    bool
+	}{
+		{"first claim", "s1", "alice", true},
+		{"same owner", "s1", "alice", true},
+		{"other owner", "s1", "bob", false},
+		{"other session", "s2", "bob", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := store.Claim(tc.session, tc.principal); got != tc.expect {
+				t.Errorf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestMemorySessionStoreSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store, err := LoadMemorySessionStore(path)
+	if err != nil || store.Len() != 0 {
+		t.Fatalf("expected an empty store for a missing file, got %d sessions, %v", store.Len(), err)
+	}
+
+	u, _ := url.Parse("https://example.com/app/login")
+	store.Jar("a").SetCookies(u, []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "remember", Value: "2", Path: "/", MaxAge: 3600},
+		{Name: "stale", Value: "3", Expires: time.Now().Add(-time.Hour)},
+		{Name: "dropped", Value: "4", Path: "/"},
+	})
+	store.Jar("a").SetCookies(u, []*http.Cookie{
+		{Name: "dropped", Path: "/", MaxAge: -1},
+		{Name: "remember", Value: "5", Path: "/", MaxAge: 3600, Secure: true},
+	})
+	store.Claim("a", "alice")
+	store.Claim("b", "bob")
+
+	if err := store.Save(path); err != nil {
+		t.Fatalf("failed to save sessions: %v", err)
+	}
+
+	loaded, err := LoadMemorySessionStore(path)
+	if err != nil {
+		t.Fatalf("failed to load sessions: %v", err)
+	}
+
+	testCases := []struct {
+		url    string
+		expect string
+	}{
+		{"https://example.com/app/page", "session=1; remember=5"},
+		{"https://example.com/", "remember=5"},
+		{"http://example.com/app/page", "session=1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			u, _ := url.Parse(tc.url)
+			req := &http.Request{Header: http.Header{}}
+			for _, c := range loaded.Jar("a").Cookies(u) {
+				req.AddCookie(c)
+			}
+			if got := req.Header.Get("Cookie"); got != tc.expect {
+				t.Errorf("expected cookies %q, got %q", tc.expect, got)
+			}
+		})
+	}
+
+	if !loaded.Claim("a", "alice") || loaded.Claim("a", "bob") || loaded.Claim("b", "alice") {
+		t.Error("expected session owners to survive a restart")
+	}
+}
+
+type recordingStore struct {
+	*MemorySessionStore
+	sessions []string
+}
+
+func (s *recordingStore) Jar(session string) http.CookieJar {
+	s.sessions = append(s.sessions, session)
+	return s.MemorySessionStore.Jar(session)
+}
+
+func TestProxySessionStore(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer service.Close()
+
+	store := &recordingStore{MemorySessionStore: NewMemorySessionStore()}
+	proxy := NewProxy(&http.Client{}, WithSessionStore(store))
+
+	r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+	r.AddCookie(&http.Cookie{Name: proxySessionCookie, Value: "known"})
+	proxy.ServeHTTP(newMockResponseWriter(), r)
+
+	if len(store.sessions) != 1 || store.sessions[0] != "known" {
+		t.Errorf("expected the proxy to use the supplied store, got %v", store.sessions)
+	}
+}
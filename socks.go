@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	socksReplyGeneralFailure     = 0x01
+	socksReplyNotAllowed         = 0x02
+	socksReplyNetworkUnreachable = 0x03
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyCommandUnsupported = 0x07
+	socksReplyAddressUnsupported = 0x08
+
+	socksSessionPrefix = "socks:"
+)
+
+// SOCKSServer is a SOCKS5 front end (CONNECT only) that shares the host
+// policy, upstream rules and drain state of a Proxy.
+type SOCKSServer struct {
+	proxy       *Proxy
+	users       map[string]string
+	sessionJar  bool
+	dialTimeout time.Duration
+	sniffWait   time.Duration
+	mu          sync.Mutex
+	listeners   map[net.Listener]struct{}
+	conns       map[net.Conn]struct{}
+}
+
+// NewSOCKSServer returns a server for proxy. With users set, clients must
+// authenticate with a user name and password. With sessionJar, plain HTTP over
+// a tunnel is served through the proxy with a cookie jar per user.
+func NewSOCKSServer(proxy *Proxy, users map[string]string, sessionJar bool) *SOCKSServer {
+	return &SOCKSServer{
+		proxy:       proxy,
+		users:       users,
+		sessionJar:  sessionJar,
+		dialTimeout: 10 * time.Second,
+		sniffWait:   300 * time.Millisecond,
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on ln until it is closed.
+func (s *SOCKSServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		if s.proxy.Draining() {
+			conn.Close()
+			continue
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Shutdown closes the listeners. Open tunnels are left to Proxy.Drain.
+func (s *SOCKSServer) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// Close closes the listeners and every open connection.
+func (s *SOCKSServer) Close() {
+	s.Shutdown()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *SOCKSServer) handle(conn net.Conn) {
+	done := s.proxy.trackTunnel(conn)
+	defer done()
+
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	conn.SetDeadline(time.Now().Add(s.dialTimeout))
+
+	br := bufio.NewReader(conn)
+	user, err := s.negotiate(br, conn)
+	if err != nil {
+		s.proxy.logger.Debug("socks handshake failed", "client", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+
+	addr, code := s.readRequest(br)
+	if code != socksReplySucceeded {
+		writeSocksReply(conn, code, nil)
+		return
+	}
+
+	logger := s.proxy.logger.With("client", conn.RemoteAddr().String(), "user", user, "target", addr)
+
+	if err := s.proxy.Policy().Hosts.check(addr); err != nil {
+		logger.Warn("socks connection denied", "error", err)
+		writeSocksReply(conn, socksReplyNotAllowed, nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+	target, err := s.proxy.upstream.DialContext(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		logger.Warn("socks connect failed", "error", err)
+		writeSocksReply(conn, socksReplyCode(err), nil)
+		return
+	}
+	defer target.Close()
+
+	if err := writeSocksReply(conn, socksReplySucceeded, target.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	logger.Info("socks connection established")
+
+	if s.sessionJar && user != "" && s.sniffHTTP(conn, br) {
+		target.Close()
+		s.serveHTTP(conn, br, addr, user)
+		return
+	}
+
+	go func() {
+		io.Copy(target, br)
+		if tcp, ok := target.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	io.Copy(conn, target)
+}
+
+func (s *SOCKSServer) negotiate(br *bufio.Reader, conn net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion5 {
+		return "", errors.New("unsupported socks version")
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(socksAuthNone)
+	if len(s.users) > 0 {
+		want = socksAuthPassword
+	}
+
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion5, socksAuthNoAcceptable})
+		return "", errors.New("no acceptable authentication method")
+	}
+
+	if _, err := conn.Write([]byte{socksVersion5, want}); err != nil {
+		return "", err
+	}
+
+	if want == socksAuthNone {
+		return "", nil
+	}
+
+	var version [1]byte
+	if _, err := io.ReadFull(br, version[:]); err != nil {
+		return "", err
+	}
+	user, err := readSocksString(br)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSocksString(br)
+	if err != nil {
+		return "", err
+	}
+
+	expected, ok := s.users[user]
+	if version[0] != 0x01 || !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return "", errors.New("invalid credentials")
+	}
+
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return user, err
+}
+
+func readSocksString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n[0])
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+func (s *SOCKSServer) readRequest(br *bufio.Reader) (string, byte) {
+	var header [3]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return "", socksReplyGeneralFailure
+	}
+
+	addr, err := readSocksAddr(br)
+	if err != nil {
+		return "", socksReplyAddressUnsupported
+	}
+
+	if header[1] != socksCmdConnect {
+		return "", socksReplyCommandUnsupported
+	}
+
+	return addr, socksReplySucceeded
+}
+
+func writeSocksReply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion5, code, 0x00}
+
+	var err error
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		reply, err = appendSocksAddr(reply, tcp.String())
+	} else {
+		reply, err = appendSocksAddr(reply, "0.0.0.0:0")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(reply)
+	return err
+}
+
+func socksReplyCode(err error) byte {
+	var policyErr *PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		return socksReplyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socksReplyHostUnreachable
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socksReplyHostUnreachable
+	}
+
+	return socksReplyGeneralFailure
+}
+
+var httpMethodPrefixes = []string{"GET ", "HEAD", "POST", "PUT ", "PATC", "DELE", "OPTI"}
+
+func (s *SOCKSServer) sniffHTTP(conn net.Conn, br *bufio.Reader) bool {
+	conn.SetReadDeadline(time.Now().Add(s.sniffWait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix, err := br.Peek(4)
+	if err != nil {
+		return false
+	}
+
+	for _, method := range httpMethodPrefixes {
+		if string(prefix) == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *SOCKSServer) serveHTTP(conn net.Conn, br *bufio.Reader, addr, user string) {
+	client := &http.Client{
+		Jar: s.proxy.sessions.Jar(socksSessionPrefix + user),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		policy := s.proxy.Policy()
+		client.Transport = s.proxy.transport(policy)
+
+		req.RequestURI = ""
+		req.URL.Scheme = "http"
+		req.URL.Host = addr
+		if req.Host == "" {
+			req.Host = addr
+		}
+
+		ctx, timer := withPhaseTimeouts(withSession(context.Background(), socksSessionPrefix+user), policy.Timeouts.forHost(addr))
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			err = timer.err(err)
+			timer.close()
+			s.proxy.logger.Warn("upstream request failed", "host", addr, "error", err)
+
+			resp = &http.Response{
+				StatusCode: StatusForUpstreamError(err),
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Body:       http.NoBody,
+				Close:      true,
+			}
+			resp.Write(conn)
+			return
+		}
+
+		resp.Body = timer.watchBody(resp.Body)
+		resp.Header.Del("Set-Cookie")
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+
+		err = resp.Write(conn)
+		resp.Body.Close()
+		timer.close()
+
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func startSOCKSServer(t *testing.T, proxy *Proxy, users map[string]string, sessionJar bool) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := NewSOCKSServer(proxy, users, sessionJar)
+	go server.Serve(ln)
+	t.Cleanup(server.Close)
+
+	return ln.Addr().String()
+}
+
+func socksGet(socksAddr string, user *url.Userinfo, target string) (*http.Response, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := socks5Connect(conn, user, targetURL.Host); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return http.ReadResponse(bufio.NewReader(conn), req)
+}
+
+func TestSOCKSServerConnect(t *testing.T) {
+	service := mockTargetService()
+	defer service.Close()
+
+	t.Run("tunnels without authentication", func(t *testing.T) {
+		addr := startSOCKSServer(t, NewProxy(&http.Client{}), nil, false)
+
+		resp, err := socksGet(addr, nil, service.URL)
+		if err != nil {
+			t.Fatalf("request through socks failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("requires valid credentials", func(t *testing.T) {
+		addr := startSOCKSServer(t, NewProxy(&http.Client{}), map[string]string{"alice": "secret"}, false)
+
+		if _, err := socksGet(addr, url.UserPassword("alice", "wrong"), service.URL); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+			t.Errorf("expected authentication failure, got %v", err)
+		}
+
+		if _, err := socksGet(addr, nil, service.URL); err == nil {
+			t.Error("expected unauthenticated client to be rejected")
+		}
+
+		resp, err := socksGet(addr, url.UserPassword("alice", "secret"), service.URL)
+		if err != nil {
+			t.Fatalf("request with valid credentials failed: %v", err)
+		}
+		resp.Body.Close()
+	})
+
+	t.Run("applies host policy", func(t *testing.T) {
+		policy := DefaultPolicy()
+		policy.Hosts.Deny = []string{"127.0.0.1"}
+		addr := startSOCKSServer(t, NewProxy(&http.Client{}, WithPolicy(policy)), nil, false)
+
+		_, err := socksGet(addr, nil, service.URL)
+		if err == nil || !strings.Contains(err.Error(), "reply code 2") {
+			t.Errorf("expected connection not allowed by ruleset, got %v", err)
+		}
+	})
+
+	t.Run("reports connection refused", func(t *testing.T) {
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+
+		addr := startSOCKSServer(t, NewProxy(&http.Client{}), nil, false)
+
+		_, err := socksGet(addr, nil, closed.URL)
+		if err == nil || !strings.Contains(err.Error(), "reply code 5") {
+			t.Errorf("expected connection refused reply, got %v", err)
+		}
+	})
+}
+
+func TestSOCKSServerSessionJar(t *testing.T) {
+	var withCookie atomic.Int64
+	service := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("session-token"); err == nil {
+				withCookie.Add(1)
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session-token", Value: "abc123", Path: "/"})
+			w.Write([]byte("ok"))
+		}),
+	)
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{})
+	addr := startSOCKSServer(t, proxy, map[string]string{"alice": "secret", "bob": "hunter2"}, true)
+
+	for i := 0; i < 2; i++ {
+		resp, err := socksGet(addr, url.UserPassword("alice", "secret"), service.URL)
+		if err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+		resp.Body.Close()
+
+		if len(resp.Cookies()) != 0 {
+			t.Errorf("request %d: expected upstream cookies to stay in the session jar", i)
+		}
+	}
+
+	resp, err := socksGet(addr, url.UserPassword("bob", "hunter2"), service.URL)
+	if err != nil {
+		t.Fatalf("request for second user failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if withCookie.Load() != 1 {
+		t.Errorf("expected only alice's second request to carry the cookie, got %d", withCookie.Load())
+	}
+}
+
+func TestSOCKSServerSessionJarHTTP2Upstream(t *testing.T) {
+	service := serveHTTP2(t, protoHandler(), HTTP2Config{H2C: true})
+
+	policy := DefaultPolicy()
+	policy.HTTP2 = UpstreamHTTP2{H2CHosts: []string{"127.0.0.1"}}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+	addr := startSOCKSServer(t, proxy, map[string]string{"alice": "secret"}, true)
+
+	resp, err := socksGet(addr, url.UserPassword("alice", "secret"), "http://"+service)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Proto != "HTTP/1.1" || string(body) != "HTTP/2.0" {
+		t.Errorf("expected an HTTP/1.1 response relaying HTTP/2.0, got %s relaying %q", resp.Proto, body)
+	}
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+const targetHeader = "X-Proxy-Target"
+
+// TargetPolicy controls how origin-form requests name their target, either in
+// the X-Proxy-Target header or as a signed /p/ path. DefaultScheme is used when
+// the target has none.
+type TargetPolicy struct {
+	DefaultScheme string   `json:"default_scheme,omitempty"`
+	SigningKeys   []string `json:"signing_keys,omitempty"`
+	RequireSigned bool     `json:"require_signed,omitempty"`
+}
+
+func (t TargetPolicy) validate() error {
+	var errs []error
+	if t.DefaultScheme != "" && t.DefaultScheme != "http" && t.DefaultScheme != "https" {
+		errs = append(errs, fmt.Errorf("default_scheme must be \"http\" or \"https\", got %q", t.DefaultScheme))
+	}
+	for i, key := range t.SigningKeys {
+		if len(key) < 16 {
+			errs = append(errs, fmt.Errorf("signing_keys[%d]: must be at least 16 bytes", i))
+		}
+	}
+	if t.RequireSigned && len(t.SigningKeys) == 0 {
+		errs = append(errs, errors.New("require_signed needs at least one signing key"))
+	}
+	return errors.Join(errs...)
+}
+
+// SignTarget returns a /p/ path that proxies to target until expires.
+func SignTarget(key, target string, expires time.Time) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(target))
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return "/p/" + targetSignature(key, expiry, encoded) + "/" + expiry + "/" + encoded
+}
+
+func targetSignature(key, expiry, encoded string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(expiry + "/" + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func decodeTarget(encoded string) (string, error) {
+	target, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil || len(target) == 0 {
+		return "", newProblem(http.StatusBadRequest, CodeInvalidTarget, "the target is not valid URL-safe base64")
+	}
+	return string(target), nil
+}
+
+func resolveTarget(r *http.Request, policy TargetPolicy, now time.Time) (string, error) {
+	target, err := extractTarget(r, policy, now)
+	if err != nil {
+		return "", err
+	}
+	return parseTarget(target, policy)
+}
+
+func extractTarget(r *http.Request, policy TargetPolicy, now time.Time) (string, error) {
+	path := r.URL.EscapedPath()
+
+	if rest, ok := strings.CutPrefix(path, "/proxy/"); ok {
+		if policy.RequireSigned {
+			return "", newProblem(http.StatusForbidden, CodeInvalidSignature, "only signed /p/ links are accepted")
+		}
+
+		switch {
+		case rest == "":
+			target := r.Header.Get(targetHeader)
+			if target == "" {
+				return "", newProblem(http.StatusBadRequest, CodeInvalidTarget, "the path or the "+targetHeader+" header must name a target")
+			}
+			return target, nil
+		case strings.HasPrefix(rest, "b64/"):
+			return decodeTarget(strings.TrimPrefix(rest, "b64/"))
+		}
+
+		if r.URL.RawQuery != "" {
+			rest += "?" + r.URL.RawQuery
+		}
+		return rest, nil
+	}
+
+	if rest, ok := strings.CutPrefix(path, "/p/"); ok {
+		parts := strings.Split(rest, "/")
+		if len(parts) != 3 {
+			return "", newProblem(http.StatusForbidden, CodeInvalidSignature, "signed links must be /p/<signature>/<expiry>/<base64url>")
+		}
+		return signedTarget(parts[0], parts[1], parts[2], policy, now)
+	}
+
+	return "", newProblem(http.StatusBadRequest, CodeInvalidTarget, "the path must be /proxy/<url>, /proxy/b64/<base64url> or /p/<signature>/<expiry>/<base64url>")
+}
+
+func parseTarget(raw string, policy TargetPolicy) (string, error) {
+	invalid := func(format string, args ...any) error {
+		return newProblem(http.StatusBadRequest, CodeInvalidTarget, fmt.Sprintf(format, args...))
+	}
+
+	if i := strings.IndexByte(raw, '%'); i > 0 && validScheme(raw[:i]) && strings.HasPrefix(strings.ToUpper(raw[i:min(len(raw), i+9)]), "%3A%2F%2F") {
+		unescaped, err := url.PathUnescape(raw)
+		if err != nil {
+			return "", invalid("the target is not a valid URL")
+		}
+		raw = unescaped
+	}
+
+	if scheme, rest, ok := strings.Cut(raw, ":/"); ok && validScheme(scheme) && !strings.HasPrefix(rest, "/") {
+		raw = scheme + "://" + rest
+	}
+
+	if scheme, _, ok := strings.Cut(raw, "://"); !ok || !validScheme(scheme) {
+		if policy.DefaultScheme == "" {
+			return "", invalid("the target needs an http:// or https:// scheme")
+		}
+		raw = policy.DefaultScheme + "://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", invalid("the target is not a valid URL")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", invalid("the scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", invalid("the target has no host")
+	}
+
+	if host := u.Hostname(); !isASCII(host) {
+		ascii, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", invalid("the host %q is not a valid internationalized domain name", host)
+		}
+		if port := u.Port(); port != "" {
+			ascii = net.JoinHostPort(ascii, port)
+		}
+		u.Host = ascii
+	}
+
+	return u.String(), nil
+}
+
+func validScheme(scheme string) bool {
+	if scheme == "" {
+		return false
+	}
+	for i, c := range scheme {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func signedTarget(signature, expiry, encoded string, policy TargetPolicy, now time.Time) (string, error) {
+	if len(policy.SigningKeys) == 0 {
+		return "", newProblem(http.StatusForbidden, CodeInvalidSignature, "signed links are not enabled")
+	}
+
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", newProblem(http.StatusForbidden, CodeInvalidSignature, "the expiry is not a unix timestamp")
+	}
+
+	valid := false
+	for _, key := range policy.SigningKeys {
+		if hmac.Equal([]byte(signature), []byte(targetSignature(key, expiry, encoded))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", newProblem(http.StatusForbidden, CodeInvalidSignature, "the link signature does not match")
+	}
+	if now.Unix() > expires {
+		return "", newProblem(http.StatusForbidden, CodeInvalidSignature, "the link has expired")
+	}
+
+	return decodeTarget(encoded)
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var parseTargetCases = []struct {
+	name          string
+	raw           string
+	defaultScheme string
+	expect        string
+}{
+	{name: "plain", raw: "https://example.com/a?b=1", expect: "https://example.com/a?b=1"},
+	{name: "encoded slash kept", raw: "https://example.com/a%2Fb", expect: "https://example.com/a%2Fb"},
+	{name: "collapsed slashes", raw: "https:/example.com/a", expect: "https://example.com/a"},
+	{name: "upper case scheme", raw: "HTTP://example.com/", expect: "http://example.com/"},
+	{name: "fully escaped", raw: "https%3A%2F%2Fexample.com%2Fa%3Fb%3D1", expect: "https://example.com/a?b=1"},
+	{name: "nested proxy path", raw: "https://example.com/proxy/https://other.com/", expect: "https://example.com/proxy/https://other.com/"},
+	{name: "idn host", raw: "https://bücher.example/x", expect: "https://xn--bcher-kva.example/x"},
+	{name: "escaped idn host", raw: "https://b%C3%BCcher.example:8443/x", expect: "https://xn--bcher-kva.example:8443/x"},
+	{name: "ipv6", raw: "http://[::1]:8080/", expect: "http://[::1]:8080/"},
+	{name: "schemeless rejected", raw: "example.com/a"},
+	{name: "schemeless defaulted", raw: "example.com:8080/a", defaultScheme: "https", expect: "https://example.com:8080/a"},
+	{name: "schemeless with url in query", raw: "example.com/r?to=https://x.com", defaultScheme: "http", expect: "http://example.com/r?to=https://x.com"},
+	{name: "ftp rejected", raw: "ftp://example.com/file"},
+	{name: "javascript rejected", raw: "javascript:alert(1)", defaultScheme: "https"},
+	{name: "file rejected", raw: "file:///etc/passwd"},
+	{name: "missing host", raw: "https:///path"},
+	{name: "bad idn", raw: "https://a‍́.example/"},
+	{name: "empty", raw: ""},
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, tc := range parseTargetCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTarget(tc.raw, TargetPolicy{DefaultScheme: tc.defaultScheme})
+			if tc.expect == "" {
+				if err == nil || classifyError(err).Code != CodeInvalidTarget {
+					t.Fatalf("expected invalid-target, got %q, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func FuzzParseTarget(f *testing.F) {
+	for _, tc := range parseTargetCases {
+		f.Add(tc.raw, tc.defaultScheme)
+	}
+
+	f.Fuzz(func(t *testing.T, raw, defaultScheme string) {
+		if defaultScheme != "" && defaultScheme != "http" && defaultScheme != "https" {
+			return
+		}
+		policy := TargetPolicy{DefaultScheme: defaultScheme}
+
+		got, err := parseTarget(raw, policy)
+		if err != nil {
+			if problem := classifyError(err); problem.Code != CodeInvalidTarget || problem.Status != http.StatusBadRequest {
+				t.Fatalf("expected a 400 invalid-target, got %+v", problem)
+			}
+			return
+		}
+
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Fatalf("parsed target %q does not parse again: %v", got, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			t.Errorf("unexpected scheme in %q", got)
+		}
+		if u.Hostname() == "" || !utf8.ValidString(u.Host) || !isASCII(u.Host) {
+			t.Errorf("expected an ASCII host in %q", got)
+		}
+		if again, err := parseTarget(got, policy); err != nil || again != got {
+			t.Errorf("expected %q to be stable, got %q, %v", got, again, err)
+		}
+	})
+}
+
+func TestResolveTarget(t *testing.T) {
+	const key = "0123456789abcdef"
+	now := time.Unix(1_700_000_000, 0)
+	target := "https://example.com/a%2Fb?q=1#frag"
+
+	signed := SignTarget(key, target, now.Add(time.Minute))
+	expired := SignTarget(key, target, now.Add(-time.Minute))
+	forged := SignTarget("fedcba9876543210", target, now.Add(time.Minute))
+	signing := TargetPolicy{SigningKeys: []string{"rotated-key-000000", key}}
+
+	testCases := []struct {
+		name        string
+		path        string
+		header      string
+		policy      TargetPolicy
+		expect      string
+		expectError ErrorCode
+	}{
+		{name: "raw path", path: "/proxy/https://example.com/x?y=1", expect: "https://example.com/x?y=1"},
+		{name: "proxy prefix not at root", path: "/api/proxy/https://example.com/x", expectError: CodeInvalidTarget},
+		{name: "base64", path: "/proxy/b64/" + base64.RawURLEncoding.EncodeToString([]byte(target)), expect: target},
+		{name: "padded base64", path: "/proxy/b64/" + base64.URLEncoding.EncodeToString([]byte("https://example.com/ab")), expect: "https://example.com/ab"},
+		{name: "bad base64", path: "/proxy/b64/!!", expectError: CodeInvalidTarget},
+		{name: "header", path: "/proxy/", header: target, expect: target},
+		{name: "missing target", path: "/proxy/", expectError: CodeInvalidTarget},
+		{name: "signed", path: signed, policy: signing, expect: target},
+		{name: "signed prefix not at root", path: "/links" + signed, policy: signing, expectError: CodeInvalidTarget},
+		{name: "raw path behind signed prefix", path: "/p/x/proxy/https://example.com/", policy: signing, expectError: CodeInvalidSignature},
+		{name: "expired", path: expired, policy: signing, expectError: CodeInvalidSignature},
+		{name: "wrong key", path: forged, policy: signing, expectError: CodeInvalidSignature},
+		{name: "tampered target", path: signed[:len(signed)-2] + "AA", policy: signing, expectError: CodeInvalidSignature},
+		{name: "signing disabled", path: signed, expectError: CodeInvalidSignature},
+		{name: "unsigned rejected", path: "/proxy/https://example.com/", policy: TargetPolicy{SigningKeys: []string{key}, RequireSigned: true}, expectError: CodeInvalidSignature},
+		{name: "unknown path", path: "/elsewhere", expectError: CodeInvalidTarget},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.URL.Path = strings.SplitN(tc.path, "?", 2)[0]
+			if _, query, ok := strings.Cut(tc.path, "?"); ok {
+				r.URL.RawQuery = query
+			}
+			if tc.header != "" {
+				r.Header.Set(targetHeader, tc.header)
+			}
+
+			got, err := resolveTarget(r, tc.policy, now)
+			if tc.expectError != "" {
+				if err == nil || classifyError(err).Code != tc.expectError {
+					t.Fatalf("expected %s, got %q, %v", tc.expectError, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestProxyTargetModes(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Target-Header", r.Header.Get(targetHeader))
+		w.Write([]byte(r.URL.EscapedPath() + "?" + r.URL.RawQuery))
+	}))
+	defer service.Close()
+
+	const key = "0123456789abcdef"
+	policy := DefaultPolicy()
+	policy.Targets = TargetPolicy{SigningKeys: []string{key}}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	target := service.URL + "/files/a%2Fb?id=7"
+
+	testCases := []struct {
+		name   string
+		path   string
+		header string
+	}{
+		{"raw", "/proxy/" + target, ""},
+		{"collapsed raw", "/proxy/" + strings.Replace(target, "://", ":/", 1), ""},
+		{"base64", "/proxy/b64/" + base64.RawURLEncoding.EncodeToString([]byte(target)), ""},
+		{"header", "/proxy/", target},
+		{"signed", SignTarget(key, target, time.Now().Add(time.Hour)), ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.header != "" {
+				r.Header.Set(targetHeader, tc.header)
+			}
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.buffer.String())
+			}
+			if w.buffer.String() != "/files/a%2Fb?id=7" {
+				t.Errorf("expected encoded slash and query to survive, got %q", w.buffer.String())
+			}
+			if w.Header().Get("X-Seen-Target-Header") != "" {
+				t.Errorf("expected %s to be stripped before forwarding", targetHeader)
+			}
+		})
+	}
+}
+
+func TestProxySignedRouteRequiresSignature(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer service.Close()
+
+	const key = "0123456789abcdef"
+	policy := DefaultPolicy()
+	policy.Targets = TargetPolicy{SigningKeys: []string{key}}
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+	auth := NewAuthMiddleware("proxy", NewAPIKeyAuthenticator(map[string]string{"secret": "alice"}))
+	router := chi.NewRouter()
+	router.With(auth.Handler).Handle("/proxy/*", proxy)
+	router.Handle("/p/*", proxy)
+
+	testCases := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"unsigned without credentials", "/proxy/" + service.URL, http.StatusUnauthorized},
+		{"raw path behind /p/", "/p/x/proxy/" + service.URL, http.StatusForbidden},
+		{"base64 behind /p/", "/p/x/proxy/b64/" + base64.RawURLEncoding.EncodeToString([]byte(service.URL)), http.StatusForbidden},
+		{"signed", SignTarget(key, service.URL, time.Now().Add(time.Hour)), http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if tc.status != http.StatusOK && strings.Contains(w.Body.String(), "upstream") {
+				t.Errorf("expected the upstream body to stay hidden, got %q", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// TimeoutPhase names the part of an upstream exchange a timeout applies to.
+type TimeoutPhase string
+
+// Timeout phases, in the order they happen.
+const (
+	PhaseDial           TimeoutPhase = "dial"
+	PhaseTLSHandshake   TimeoutPhase = "tls-handshake"
+	PhaseResponseHeader TimeoutPhase = "response-header"
+	PhaseIdleBody       TimeoutPhase = "idle-body"
+	PhaseTotal          TimeoutPhase = "total"
+)
+
+// Timeouts bounds each phase of an upstream exchange. A zero field means no
+// limit for that phase.
+type Timeouts struct {
+	Dial           time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	IdleBody       time.Duration
+	Total          time.Duration
+}
+
+func (t Timeouts) merge(override Timeouts) Timeouts {
+	if override.Dial > 0 {
+		t.Dial = override.Dial
+	}
+	if override.TLSHandshake > 0 {
+		t.TLSHandshake = override.TLSHandshake
+	}
+	if override.ResponseHeader > 0 {
+		t.ResponseHeader = override.ResponseHeader
+	}
+	if override.IdleBody > 0 {
+		t.IdleBody = override.IdleBody
+	}
+	if override.Total > 0 {
+		t.Total = override.Total
+	}
+	return t
+}
+
+func (t Timeouts) isZero() bool {
+	return t == Timeouts{}
+}
+
+// TimeoutOverride replaces the non-zero fields of the default timeouts for
+// hosts matching Host.
+type TimeoutOverride struct {
+	Host     string
+	Timeouts Timeouts
+}
+
+// TimeoutConfig holds the default timeouts and per-host overrides. The first
+// matching override wins.
+type TimeoutConfig struct {
+	Default   Timeouts
+	Overrides []TimeoutOverride
+}
+
+func (c TimeoutConfig) forHost(host string) Timeouts {
+	for _, override := range c.Overrides {
+		if matchHost(override.Host, host) {
+			return c.Default.merge(override.Timeouts)
+		}
+	}
+	return c.Default
+}
+
+// PhaseTimeoutError reports that an upstream phase took longer than allowed.
+type PhaseTimeoutError struct {
+	Phase TimeoutPhase
+	After time.Duration
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout after %s", e.Phase, e.After)
+}
+
+func (e *PhaseTimeoutError) Timeout() bool   { return true }
+func (e *PhaseTimeoutError) Temporary() bool { return true }
+
+// timerKey tells apart timers of the same phase, such as the parallel dials
+// of happy eyeballs, which each get their own dial timeout.
+type timerKey struct {
+	phase TimeoutPhase
+	addr  string
+}
+
+type phaseTimer struct {
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	timeouts Timeouts
+	timers   map[timerKey]*time.Timer
+	mu       sync.Mutex
+}
+
+func withPhaseTimeouts(parent context.Context, timeouts Timeouts) (context.Context, *phaseTimer) {
+	ctx, cancel := context.WithCancelCause(parent)
+	pt := &phaseTimer{
+		ctx:      ctx,
+		cancel:   cancel,
+		timeouts: timeouts,
+		timers:   make(map[timerKey]*time.Timer),
+	}
+
+	if timeouts.isZero() {
+		return ctx, pt
+	}
+
+	pt.start(timerKey{phase: PhaseTotal}, timeouts.Total)
+
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			pt.start(timerKey{PhaseDial, network + "/" + addr}, timeouts.Dial)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			pt.stop(timerKey{PhaseDial, network + "/" + addr})
+		},
+		TLSHandshakeStart: func() {
+			pt.start(timerKey{phase: PhaseTLSHandshake}, timeouts.TLSHandshake)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			pt.stop(timerKey{phase: PhaseTLSHandshake})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			pt.start(timerKey{phase: PhaseResponseHeader}, timeouts.ResponseHeader)
+		},
+		GotFirstResponseByte: func() {
+			pt.stop(timerKey{phase: PhaseResponseHeader})
+		},
+	}
+
+	return httptrace.WithClientTrace(ctx, trace), pt
+}
+
+func (pt *phaseTimer) start(key timerKey, d time.Duration) *time.Timer {
+	if d <= 0 {
+		return nil
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if t, ok := pt.timers[key]; ok {
+		return t
+	}
+
+	t := time.AfterFunc(d, func() {
+		pt.cancel(&PhaseTimeoutError{Phase: key.phase, After: d})
+	})
+	pt.timers[key] = t
+	return t
+}
+
+func (pt *phaseTimer) stop(key timerKey) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if t, ok := pt.timers[key]; ok {
+		t.Stop()
+		delete(pt.timers, key)
+	}
+}
+
+func (pt *phaseTimer) close() {
+	pt.mu.Lock()
+	for key, t := range pt.timers {
+		t.Stop()
+		delete(pt.timers, key)
+	}
+	pt.mu.Unlock()
+
+	pt.cancel(context.Canceled)
+}
+
+func (pt *phaseTimer) err(err error) error {
+	var phaseErr *PhaseTimeoutError
+	if errors.As(context.Cause(pt.ctx), &phaseErr) {
+		return phaseErr
+	}
+	return err
+}
+
+func (pt *phaseTimer) watchBody(body io.ReadCloser) io.ReadCloser {
+	if pt.timeouts.IdleBody <= 0 {
+		return body
+	}
+
+	timer := pt.start(timerKey{phase: PhaseIdleBody}, pt.timeouts.IdleBody)
+	return &idleBody{ReadCloser: body, timer: timer, idle: pt.timeouts.IdleBody}
+}
+
+type idleBody struct {
+	io.ReadCloser
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timer.Stop() {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+func timeoutPhase(err error) (TimeoutPhase, bool) {
+	var phaseErr *PhaseTimeoutError
+	if errors.As(err, &phaseErr) {
+		return phaseErr.Phase, true
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return PhaseTotal, true
+	}
+
+	var timeoutErr interface{ Timeout() bool }
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+		return PhaseTotal, true
+	}
+
+	return "", false
+}
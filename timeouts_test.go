@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+)
+
+func TestTimeoutConfigForHost(t *testing.T) {
+	cfg := TimeoutConfig{
+		Default: Timeouts{
+			Dial:           time.Second,
+			ResponseHeader: 10 * time.Second,
+			Total:          10 * time.Second,
+		},
+		Overrides: []TimeoutOverride{
+			{Host: "reports.example.com", Timeouts: Timeouts{ResponseHeader: time.Minute, Total: 2 * time.Minute}},
+			{Host: "*.internal", Timeouts: Timeouts{Dial: 100 * time.Millisecond}},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		host     string
+		expected Timeouts
+	}{
+		{
+			name:     "default",
+			host:     "example.com",
+			expected: cfg.Default,
+		},
+		{
+			name:     "exact host override keeps unset phases",
+			host:     "reports.example.com:443",
+			expected: Timeouts{Dial: time.Second, ResponseHeader: time.Minute, Total: 2 * time.Minute},
+		},
+		{
+			name:     "wildcard override",
+			host:     "db.internal",
+			expected: Timeouts{Dial: 100 * time.Millisecond, ResponseHeader: 10 * time.Second, Total: 10 * time.Second},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cfg.forHost(tc.host); got != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestProxyPhaseTimeouts(t *testing.T) {
+	slowHeaders := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("slow headers"))
+	})
+
+	slowBody := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("first chunk"))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("second chunk"))
+	})
+
+	trickleBody := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for range 5 {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	testCases := []struct {
+		name        string
+		handler     http.Handler
+		timeouts    TimeoutConfig
+		expectCode  int
+		expectError string
+	}{
+		{
+			name:        "response header timeout",
+			handler:     slowHeaders,
+			timeouts:    TimeoutConfig{Default: Timeouts{ResponseHeader: 10 * time.Millisecond}},
+			expectCode:  http.StatusGatewayTimeout,
+			expectError: "response-header-timeout",
+		},
+		{
+			name:        "idle body timeout",
+			handler:     slowBody,
+			timeouts:    TimeoutConfig{Default: Timeouts{IdleBody: 10 * time.Millisecond}},
+			expectCode:  http.StatusGatewayTimeout,
+			expectError: "idle-body-timeout",
+		},
+		{
+			name:       "steady body resets idle timeout",
+			handler:    trickleBody,
+			timeouts:   TimeoutConfig{Default: Timeouts{IdleBody: 60 * time.Millisecond}},
+			expectCode: http.StatusOK,
+		},
+		{
+			name:        "total timeout",
+			handler:     slowBody,
+			timeouts:    TimeoutConfig{Default: Timeouts{Total: 50 * time.Millisecond}},
+			expectCode:  http.StatusGatewayTimeout,
+			expectError: "total-timeout",
+		},
+		{
+			name:    "host override extends timeout",
+			handler: slowHeaders,
+			timeouts: TimeoutConfig{
+				Default:   Timeouts{ResponseHeader: 10 * time.Millisecond},
+				Overrides: []TimeoutOverride{{Host: "127.0.0.1", Timeouts: Timeouts{ResponseHeader: time.Second}}},
+			},
+			expectCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := httptest.NewServer(tc.handler)
+			defer service.Close()
+
+			proxy := NewProxy(&http.Client{}, WithTimeouts(tc.timeouts))
+
+			w := newMockResponseWriter()
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != tc.expectCode {
+				t.Fatalf("expected status code %d, got %d", tc.expectCode, w.Code)
+			}
+
+			if got := w.Header().Get("X-Proxy-Error"); got != tc.expectError {
+				t.Errorf("expected X-Proxy-Error %q, got %q", tc.expectError, got)
+			}
+		})
+	}
+}
+
+func TestPhaseTimerParallelDials(t *testing.T) {
+	ctx, timer := withPhaseTimeouts(context.Background(), Timeouts{Dial: 50 * time.Millisecond})
+	defer timer.close()
+
+	trace := httptrace.ContextClientTrace(ctx)
+	trace.ConnectStart("tcp", "[::1]:80")
+	time.Sleep(30 * time.Millisecond)
+	trace.ConnectStart("tcp", "127.0.0.1:80")
+	trace.ConnectDone("tcp", "[::1]:80", errors.New("network unreachable"))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the second dial to time out on its own")
+	}
+
+	var phaseErr *PhaseTimeoutError
+	if !errors.As(context.Cause(ctx), &phaseErr) || phaseErr.Phase != PhaseDial {
+		t.Errorf("expected a dial timeout, got %v", context.Cause(ctx))
+	}
+}
+
+func TestWithTimeoutsKeepsPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	proxy := NewProxy(&http.Client{}, WithPolicy(policy), WithTimeouts(TimeoutConfig{Default: Timeouts{Total: time.Second}}))
+
+	if policy.Timeouts.Default.Total != 0 {
+		t.Error("expected WithTimeouts to leave the shared policy unchanged")
+	}
+	if proxy.Policy().Timeouts.Default.Total != time.Second {
+		t.Errorf("expected the proxy to use the new timeouts, got %+v", proxy.Policy().Timeouts)
+	}
+}
+
+func TestWithTimeoutsBeforePolicy(t *testing.T) {
+	timeouts := TimeoutConfig{Default: Timeouts{Total: time.Second}}
+	proxy := NewProxy(&http.Client{}, WithTimeouts(timeouts), WithPolicy(DefaultPolicy()))
+
+	if proxy.Policy().Timeouts.Default.Total != time.Second {
+		t.Errorf("expected WithTimeouts to survive a later WithPolicy, got %+v", proxy.Policy().Timeouts)
+	}
+
+	proxy.SetPolicy(DefaultPolicy())
+	if proxy.Policy().Timeouts.Default.Total != time.Second {
+		t.Errorf("expected WithTimeouts to survive SetPolicy, got %+v", proxy.Policy().Timeouts)
+	}
+}
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CertificateConfig names a PEM certificate and key file.
+type CertificateConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// TLSConfig configures TLS on a listener. Dev generates a self-signed
+// certificate in DevDir. ClientAuth is "none", "request" or "require".
+type TLSConfig struct {
+	Certificates []CertificateConfig `json:"certificates,omitempty"`
+	ClientCA     string              `json:"client_ca,omitempty"`
+	ClientAuth   string              `json:"client_auth,omitempty"`
+	Dev          bool                `json:"dev,omitempty"`
+	DevDir       string              `json:"dev_dir,omitempty"`
+}
+
+func (c *TLSConfig) validate() error {
+	var errs []error
+
+	if len(c.Certificates) == 0 && !c.Dev {
+		errs = append(errs, errors.New("certificates are required unless dev is enabled"))
+	}
+	for i, pair := range c.Certificates {
+		if pair.Cert == "" || pair.Key == "" {
+			errs = append(errs, fmt.Errorf("certificates[%d]: cert and key are both required", i))
+		}
+	}
+
+	if _, err := clientAuthType(c.ClientAuth); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ClientAuth != "" && c.ClientAuth != "none" && c.ClientCA == "" {
+		errs = append(errs, errors.New("client_ca is required when client_auth is enabled"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// DevCertDir returns DevDir, or .proxy-dev-certs when it is empty.
+func (c *TLSConfig) DevCertDir() string {
+	if c.DevDir == "" {
+		return ".proxy-dev-certs"
+	}
+	return c.DevDir
+}
+
+func clientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("client_auth must be \"none\", \"request\" or \"require\", got %q", mode)
+}
+
+// NewTLSServerConfig loads the certificates and client CA of cfg.
+func NewTLSServerConfig(cfg TLSConfig) (*tls.Config, error) {
+	pairs := cfg.Certificates
+	if cfg.Dev {
+		pair, err := ensureDevCertificates(cfg.DevCertDir())
+		if err != nil {
+			return nil, fmt.Errorf("dev certificates: %w", err)
+		}
+		pairs = append(pairs, pair)
+	}
+
+	store, err := newCertStore(pairs)
+	if err != nil {
+		return nil, err
+	}
+
+	authType, err := clientAuthType(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.getCertificate,
+		ClientAuth:     authType,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if cfg.ClientCA != "" {
+		data, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+type certStore struct {
+	pairs      []CertificateConfig
+	checkEvery time.Duration
+	now        func() time.Time
+	mu         sync.RWMutex
+	certs      []*tls.Certificate
+	modTimes   []time.Time
+	lastCheck  time.Time
+}
+
+func newCertStore(pairs []CertificateConfig) (*certStore, error) {
+	s := &certStore{
+		pairs:      pairs,
+		checkEvery: time.Second,
+		now:        time.Now,
+		certs:      make([]*tls.Certificate, len(pairs)),
+		modTimes:   make([]time.Time, len(pairs)),
+	}
+
+	for i := range pairs {
+		if err := s.load(i); err != nil {
+			return nil, err
+		}
+	}
+	s.lastCheck = s.now()
+
+	return s, nil
+}
+
+func (s *certStore) load(i int) error {
+	pair := s.pairs[i]
+
+	cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pair.Cert, err)
+	}
+
+	s.certs[i] = &cert
+	s.modTimes[i] = pairModTime(pair)
+	return nil
+}
+
+func pairModTime(pair CertificateConfig) time.Time {
+	var latest time.Time
+	for _, path := range []string{pair.Cert, pair.Key} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (s *certStore) reloadIfChanged() {
+	now := s.now()
+
+	s.mu.RLock()
+	due := now.Sub(s.lastCheck) >= s.checkEvery
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastCheck) < s.checkEvery {
+		return
+	}
+	s.lastCheck = now
+
+	for i, pair := range s.pairs {
+		if pairModTime(pair).Equal(s.modTimes[i]) {
+			continue
+		}
+		// A failed load usually means the pair is mid-rotation; keep serving the old one.
+		s.load(i)
+	}
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.reloadIfChanged()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+
+	return s.certs[0], nil
+}
+
+const devCertRenewBefore = 30 * 24 * time.Hour
+
+func ensureDevCertificates(dir string) (CertificateConfig, error) {
+	pair := CertificateConfig{
+		Cert: filepath.Join(dir, "cert.pem"),
+		Key:  filepath.Join(dir, "key.pem"),
+	}
+	caCertPath := filepath.Join(dir, "ca.pem")
+	caKeyPath := filepath.Join(dir, "ca-key.pem")
+
+	ca, caErr := tls.LoadX509KeyPair(caCertPath, caKeyPath)
+	if caErr == nil && !certificateFresh(ca) {
+		caErr = errors.New("development CA is about to expire")
+	}
+	if leaf, err := tls.LoadX509KeyPair(pair.Cert, pair.Key); err == nil && caErr == nil && certificateFresh(leaf) {
+		return pair, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return pair, err
+	}
+
+	if caErr != nil {
+		var err error
+		ca, err = createCertificate(nil, []string{"proxy development CA"}, caCertPath, caKeyPath)
+		if err != nil {
+			return pair, err
+		}
+	}
+
+	_, err := createCertificate(&ca, []string{"localhost", "127.0.0.1", "::1"}, pair.Cert, pair.Key)
+	return pair, err
+}
+
+// certificateFresh reports whether cert is valid for longer than
+// devCertRenewBefore, so a dev certificate is replaced before it expires.
+func certificateFresh(cert tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	return err == nil && time.Now().Add(devCertRenewBefore).Before(leaf.NotAfter)
+}
+
+func createCertificate(ca *tls.Certificate, names []string, certPath, keyPath string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0], Organization: []string{"proxy development"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, signer := template, any(key)
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+		template.NotAfter = time.Now().AddDate(10, 0, 0)
+	} else {
+		for _, name := range names {
+			if ip := net.ParseIP(name); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, name)
+			}
+		}
+
+		parent, err = x509.ParseCertificate(ca.Certificate[0])
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		signer = ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func serveTLS(t *testing.T, cfg TLSConfig) string {
+	t.Helper()
+
+	tlsConfig, err := NewTLSServerConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to build TLS config: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(tls.NewListener(ln, tlsConfig))
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func caPool(t *testing.T, path string) *x509.CertPool {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read CA: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+	return pool
+}
+
+func handshake(addr, serverName string, config *tls.Config) (*x509.Certificate, error) {
+	config = config.Clone()
+	config.ServerName = serverName
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSDevCertificates(t *testing.T) {
+	dir := t.TempDir()
+	addr := serveTLS(t, TLSConfig{Dev: true, DevDir: dir})
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: caPool(t, filepath.Join(dir, "ca.pem"))},
+	}}
+
+	_, port, _ := net.SplitHostPort(addr)
+	resp, err := client.Get("https://localhost:" + port)
+	if err != nil {
+		t.Fatalf("expected dev certificate to be trusted through the generated CA: %v", err)
+	}
+	resp.Body.Close()
+
+	before, _ := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	if _, err := ensureDevCertificates(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after, _ := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	if string(before) != string(after) {
+		t.Error("expected existing dev certificate to be reused")
+	}
+}
+
+func TestTLSDevCertificatesRenewExpired(t *testing.T) {
+	dir := t.TempDir()
+	pair, err := ensureDevCertificates(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ca, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("failed to load CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().AddDate(-1, 0, 0),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to create expired certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	os.WriteFile(pair.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(pair.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	caBefore, _ := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if _, err := ensureDevCertificates(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	leaf, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+	if err != nil {
+		t.Fatalf("failed to load renewed certificate: %v", err)
+	}
+	renewed, _ := x509.ParseCertificate(leaf.Certificate[0])
+	if !renewed.NotAfter.After(time.Now().AddDate(0, 6, 0)) {
+		t.Errorf("expected the expired dev certificate to be renewed, expires %s", renewed.NotAfter)
+	}
+	if caAfter, _ := os.ReadFile(filepath.Join(dir, "ca.pem")); string(caBefore) != string(caAfter) {
+		t.Error("expected the dev CA to be kept")
+	}
+}
+
+func TestTLSSNIAndRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := createCertificate(nil, []string{"test CA"}, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+
+	alpha := CertificateConfig{Cert: filepath.Join(dir, "alpha.pem"), Key: filepath.Join(dir, "alpha-key.pem")}
+	beta := CertificateConfig{Cert: filepath.Join(dir, "beta.pem"), Key: filepath.Join(dir, "beta-key.pem")}
+	for name, pair := range map[string]CertificateConfig{"alpha.test": alpha, "beta.test": beta} {
+		if _, err := createCertificate(&ca, []string{name}, pair.Cert, pair.Key); err != nil {
+			t.Fatalf("failed to create certificate: %v", err)
+		}
+	}
+
+	store, err := newCertStore([]CertificateConfig{alpha, beta})
+	if err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	tlsConfig, err := NewTLSServerConfig(TLSConfig{Certificates: []CertificateConfig{alpha, beta}})
+	if err != nil {
+		t.Fatalf("failed to build TLS config: %v", err)
+	}
+	tlsConfig.GetCertificate = store.getCertificate
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	go srv.Serve(tls.NewListener(ln, tlsConfig))
+	defer srv.Close()
+
+	clientConfig := &tls.Config{RootCAs: caPool(t, filepath.Join(dir, "ca.pem"))}
+
+	for _, name := range []string{"alpha.test", "beta.test"} {
+		cert, err := handshake(ln.Addr().String(), name, clientConfig)
+		if err != nil {
+			t.Fatalf("%s: handshake failed: %v", name, err)
+		}
+		if cert.DNSNames[0] != name {
+			t.Errorf("expected certificate for %s, got %v", name, cert.DNSNames)
+		}
+	}
+
+	original, _ := handshake(ln.Addr().String(), "beta.test", clientConfig)
+	if _, err := createCertificate(&ca, []string{"beta.test"}, beta.Cert, beta.Key); err != nil {
+		t.Fatalf("failed to rotate certificate: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(beta.Cert, future, future)
+	now = now.Add(2 * time.Second)
+
+	rotated, err := handshake(ln.Addr().String(), "beta.test", clientConfig)
+	if err != nil {
+		t.Fatalf("handshake after rotation failed: %v", err)
+	}
+	if rotated.SerialNumber.Cmp(original.SerialNumber) == 0 {
+		t.Error("expected rotated certificate to be served without restart")
+	}
+}
+
+func TestTLSClientVerification(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ensureDevCertificates(dir); err != nil {
+		t.Fatalf("failed to create dev certificates: %v", err)
+	}
+
+	addr := serveTLS(t, TLSConfig{
+		Dev:        true,
+		DevDir:     dir,
+		ClientCA:   filepath.Join(dir, "ca.pem"),
+		ClientAuth: "require",
+	})
+
+	roots := caPool(t, filepath.Join(dir, "ca.pem"))
+
+	noCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}}}
+	if resp, err := noCert.Get("https://" + addr); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected request without client certificate to be rejected")
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatalf("failed to load client certificate: %v", err)
+	}
+
+	withCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+	resp, err := withCert.Get("https://" + addr)
+	if err != nil {
+		t.Fatalf("expected request with client certificate to succeed: %v", err)
+	}
+	resp.Body.Close()
+}
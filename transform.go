@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ResponseTransformer rewrites a decoded response body from src into dst.
+type ResponseTransformer interface {
+	Transform(resp *http.Response, dst io.Writer, src io.Reader) error
+}
+
+// TransformRule applies Transformer to responses from Hosts with one of
+// ContentTypes. Empty lists match everything.
+type TransformRule struct {
+	Hosts        []string
+	ContentTypes []string
+	Transformer  ResponseTransformer
+}
+
+func (r TransformRule) matches(resp *http.Response) bool {
+	if len(r.Hosts) > 0 && !slices.ContainsFunc(r.Hosts, func(pattern string) bool {
+		return matchHost(pattern, resp.Request.URL.Host)
+	}) {
+		return false
+	}
+
+	if len(r.ContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return slices.ContainsFunc(r.ContentTypes, func(pattern string) bool {
+		return matchMediaType(pattern, mediaType)
+	})
+}
+
+// TransformError reports that a transformer failed.
+type TransformError struct {
+	Err error
+}
+
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("transforming response body: %v", e.Err)
+}
+
+func (e *TransformError) Unwrap() error {
+	return e.Err
+}
+
+func transformable(resp *http.Response) bool {
+	if resp.Request == nil || resp.Request.Method == http.MethodHead {
+		return false
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	return encoding == "" || encoding == encodingIdentity || slices.Contains(supportedEncodings, encoding)
+}
+
+func applyTransforms(resp *http.Response, rules []TransformRule, limit int64) (bool, error) {
+	if len(rules) == 0 || !transformable(resp) {
+		return false, nil
+	}
+
+	var matched []ResponseTransformer
+	for _, rule := range rules {
+		if rule.matches(resp) {
+			matched = append(matched, rule.Transformer)
+		}
+	}
+	if len(matched) == 0 {
+		return false, nil
+	}
+
+	var src io.Reader = resp.Body
+	closers := []io.Closer{resp.Body}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != encodingIdentity {
+		decoder, err := newDecoder(encoding, resp.Body)
+		if err != nil {
+			return false, err
+		}
+		closers = append(closers, decoder)
+		src = newLimitedBody(decoder, "response", limit)
+	}
+
+	for _, transformer := range matched {
+		pr, pw := io.Pipe()
+		go func(in io.Reader) {
+			defer func() {
+				if v := recover(); v != nil {
+					pw.CloseWithError(&TransformError{Err: fmt.Errorf("transformer panicked: %v", v)})
+				}
+			}()
+			if err := transformer.Transform(resp, pw, in); err != nil {
+				pw.CloseWithError(&TransformError{Err: err})
+				return
+			}
+			pw.Close()
+		}(src)
+		closers = append(closers, pr)
+		src = pr
+	}
+
+	resp.Body = &pipelineBody{Reader: src, closers: closers}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	weakenETag(resp)
+
+	return true, nil
+}
+
+type pipelineBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *pipelineBody) Close() error {
+	var errs []error
+	for _, c := range slices.Backward(b.closers) {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// RegexReplaceTransformer replaces every match of Pattern with Replacement.
+type RegexReplaceTransformer struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Transform implements ResponseTransformer.
+func (t *RegexReplaceTransformer) Transform(resp *http.Response, dst io.Writer, src io.Reader) error {
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(t.Pattern.ReplaceAll(body, []byte(t.Replacement)))
+	return err
+}
+
+// JSONRemoveTransformer removes the values at the given JSON pointers.
+type JSONRemoveTransformer struct {
+	Pointers []string
+}
+
+// Transform implements ResponseTransformer.
+func (t *JSONRemoveTransformer) Transform(resp *http.Response, dst io.Writer, src io.Reader) error {
+	decoder := json.NewDecoder(src)
+	decoder.UseNumber()
+
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return err
+	}
+
+	for _, pointer := range t.Pointers {
+		doc = removeJSONPointer(doc, splitJSONPointer(pointer))
+	}
+
+	encoder := json.NewEncoder(dst)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(doc)
+}
+
+func validJSONPointer(pointer string) error {
+	if !strings.HasPrefix(pointer, "/") {
+		return fmt.Errorf("JSON pointer %q must start with /", pointer)
+	}
+	return nil
+}
+
+func splitJSONPointer(pointer string) []string {
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens
+}
+
+func removeJSONPointer(doc any, tokens []string) any {
+	if len(tokens) == 0 {
+		return doc
+	}
+
+	switch v := doc.(type) {
+	case map[string]any:
+		if len(tokens) == 1 {
+			delete(v, tokens[0])
+		} else if child, ok := v[tokens[0]]; ok {
+			v[tokens[0]] = removeJSONPointer(child, tokens[1:])
+		}
+	case []any:
+		i, err := strconv.Atoi(tokens[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return doc
+		}
+		if len(tokens) == 1 {
+			return slices.Delete(v, i, i+1)
+		}
+		v[i] = removeJSONPointer(v[i], tokens[1:])
+	}
+
+	return doc
+}
+
+// HTMLPosition is where HTMLInjectTransformer inserts its snippet.
+type HTMLPosition string
+
+// HTML injection positions.
+const (
+	HTMLHeadEnd HTMLPosition = "head"
+	HTMLBodyEnd HTMLPosition = "body"
+)
+
+// HTMLInjectTransformer inserts Snippet before the closing head or body tag.
+type HTMLInjectTransformer struct {
+	Snippet  string
+	Position HTMLPosition
+}
+
+// Transform implements ResponseTransformer.
+func (t *HTMLInjectTransformer) Transform(resp *http.Response, dst io.Writer, src io.Reader) error {
+	marker := []byte("</body>")
+	if t.Position == HTMLHeadEnd {
+		marker = []byte("</head>")
+	}
+
+	var pending []byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		pending = append(pending, buf[:n]...)
+
+		if t.Position == HTMLHeadEnd {
+			if at := indexFold(pending, marker); at >= 0 {
+				if _, err := dst.Write(slices.Concat(pending[:at], []byte(t.Snippet), pending[at:])); err != nil {
+					return err
+				}
+				_, err := io.Copy(dst, src)
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		keep := max(0, len(pending)-len(marker)+1)
+		if at := lastIndexFold(pending, marker); at >= 0 {
+			keep = at
+		}
+		if _, err := dst.Write(pending[:keep]); err != nil {
+			return err
+		}
+		pending = append(pending[:0], pending[keep:]...)
+	}
+
+	at := len(pending)
+	if t.Position != HTMLHeadEnd {
+		if i := lastIndexFold(pending, marker); i >= 0 {
+			at = i
+		}
+	}
+	_, err := dst.Write(slices.Concat(pending[:at], []byte(t.Snippet), pending[at:]))
+	return err
+}
+
+func indexFold(s, sep []byte) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if equalFoldASCII(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+func lastIndexFold(s, sep []byte) int {
+	for i := len(s) - len(sep); i >= 0; i-- {
+		if equalFoldASCII(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalFoldASCII(a, lower []byte) bool {
+	for i, c := range a {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != lower[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TransformConfig is the config form of a TransformRule. Type is
+// "replace", "json_remove" or "html_inject".
+type TransformConfig struct {
+	Type         string   `json:"type"`
+	Hosts        []string `json:"hosts,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+	Pattern      string   `json:"pattern,omitempty"`
+	Replacement  string   `json:"replacement,omitempty"`
+	Pointers     []string `json:"pointers,omitempty"`
+	Snippet      string   `json:"snippet,omitempty"`
+	Position     string   `json:"position,omitempty"`
+}
+
+func (c TransformConfig) rule() (TransformRule, error) {
+	var errs []error
+	for _, pattern := range c.Hosts {
+		errs = append(errs, validHostPattern(pattern))
+	}
+	for _, pattern := range c.ContentTypes {
+		errs = append(errs, validMediaTypePattern(pattern))
+	}
+
+	rule := TransformRule{Hosts: c.Hosts, ContentTypes: c.ContentTypes}
+
+	switch c.Type {
+	case "replace":
+		pattern, err := regexp.Compile(c.Pattern)
+		if err != nil || c.Pattern == "" {
+			errs = append(errs, errors.New("replace needs a valid regular expression in pattern"))
+		}
+		rule.Transformer = &RegexReplaceTransformer{Pattern: pattern, Replacement: c.Replacement}
+		if len(rule.ContentTypes) == 0 {
+			rule.ContentTypes = []string{"text/*"}
+		}
+	case "json_remove":
+		if len(c.Pointers) == 0 {
+			errs = append(errs, errors.New("json_remove needs at least one pointer"))
+		}
+		for _, pointer := range c.Pointers {
+			errs = append(errs, validJSONPointer(pointer))
+		}
+		rule.Transformer = &JSONRemoveTransformer{Pointers: c.Pointers}
+		if len(rule.ContentTypes) == 0 {
+			rule.ContentTypes = []string{"application/json"}
+		}
+	case "html_inject":
+		if c.Snippet == "" {
+			errs = append(errs, errors.New("html_inject needs a snippet"))
+		}
+		position := HTMLPosition(c.Position)
+		if position == "" {
+			position = HTMLBodyEnd
+		}
+		if position != HTMLHeadEnd && position != HTMLBodyEnd {
+			errs = append(errs, fmt.Errorf("position must be \"head\" or \"body\", got %q", c.Position))
+		}
+		rule.Transformer = &HTMLInjectTransformer{Snippet: c.Snippet, Position: position}
+		if len(rule.ContentTypes) == 0 {
+			rule.ContentTypes = []string{"text/html"}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("type must be replace, json_remove or html_inject, got %q", c.Type))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return TransformRule{}, err
+	}
+	return rule, nil
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type upperTransformer struct{}
+
+func (upperTransformer) Transform(resp *http.Response, dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 512)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(bytes.ToUpper(buf[:n])); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type panicTransformer struct{}
+
+func (panicTransformer) Transform(resp *http.Response, dst io.Writer, src io.Reader) error {
+	panic("bad transformer")
+}
+
+func TestRemoveJSONPointer(t *testing.T) {
+	testCases := []struct {
+		pointer string
+		expect  string
+	}{
+		{"/user/ssn", `{"items":[1,2,3],"user":{"name":"a"},"x/y":1}`},
+		{"/items/1", `{"items":[1,3],"user":{"name":"a","ssn":"123"},"x/y":1}`},
+		{"/x~1y", `{"items":[1,2,3],"user":{"name":"a","ssn":"123"}}`},
+		{"/missing/field", `{"items":[1,2,3],"user":{"name":"a","ssn":"123"},"x/y":1}`},
+		{"/items/9", `{"items":[1,2,3],"user":{"name":"a","ssn":"123"},"x/y":1}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pointer, func(t *testing.T) {
+			var doc any
+			json.Unmarshal([]byte(`{"user":{"name":"a","ssn":"123"},"items":[1,2,3],"x/y":1}`), &doc)
+
+			got, _ := json.Marshal(removeJSONPointer(doc, splitJSONPointer(tc.pointer)))
+			if string(got) != tc.expect {
+				t.Errorf("expected %s, got %s", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestHTMLInjectTransformer(t *testing.T) {
+	testCases := []struct {
+		name     string
+		position HTMLPosition
+		input    string
+		expect   string
+	}{
+		{"before body end", HTMLBodyEnd, "<html><body><p>x</p></BODY></html>", "<html><body><p>x</p><b>!</b></BODY></html>"},
+		{"before head end", HTMLHeadEnd, "<html><head></head><body></body></html>", "<html><head><b>!</b></head><body></body></html>"},
+		{"no anchor", HTMLBodyEnd, "<p>fragment</p>", "<p>fragment</p><b>!</b>"},
+		{"last body end", HTMLBodyEnd, "<p></body></p></Body>tail", "<p></body></p><b>!</b></Body>tail"},
+		{"length changing lower case", HTMLBodyEnd, strings.Repeat("\u023a", 10) + "</body>", strings.Repeat("\u023a", 10) + "<b>!</b></body>"},
+		{"non-ascii fold ignored", HTMLHeadEnd, "<\u212aead></head>", "<\u212aead><b>!</b></head>"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			transformer := &HTMLInjectTransformer{Snippet: "<b>!</b>", Position: tc.position}
+			for name, src := range map[string]io.Reader{
+				"whole":    strings.NewReader(tc.input),
+				"one byte": iotest.OneByteReader(strings.NewReader(tc.input)),
+			} {
+				out.Reset()
+				if err := transformer.Transform(nil, &out, src); err != nil {
+					t.Fatalf("%s: transform failed: %v", name, err)
+				}
+				if out.String() != tc.expect {
+					t.Errorf("%s: expected %q, got %q", name, tc.expect, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestProxyTransforms(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user.json":
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write([]byte(`{"name":"alice","ssn":"123-45-6789"}`))
+			gz.Close()
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+			w.Header().Set("ETag", `"abc"`)
+			w.Write(buf.Bytes())
+		case "/broken.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":`))
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>hello internal.corp</body></html>"))
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("internal.corp"))
+		}
+	}))
+	defer service.Close()
+
+	policy := DefaultPolicy()
+	for _, cfg := range []TransformConfig{
+		{Type: "json_remove", Pointers: []string{"/ssn"}},
+		{Type: "replace", Pattern: `(?i)internal\.corp`, Replacement: "example.com"},
+		{Type: "html_inject", Snippet: "<script src=/banner.js></script>"},
+	} {
+		rule, err := cfg.rule()
+		if err != nil {
+			t.Fatalf("failed to build transform: %v", err)
+		}
+		policy.Transforms = append(policy.Transforms, rule)
+	}
+
+	proxy := NewProxy(&http.Client{},
+		WithPolicy(policy),
+		WithTransformer(TransformRule{ContentTypes: []string{"text/html"}, Transformer: upperTransformer{}}),
+	)
+
+	testCases := []struct {
+		path   string
+		status int
+		body   string
+		etag   string
+	}{
+		{"/user.json", http.StatusOK, `{"name":"alice"}` + "\n", `W/"abc"`},
+		{"/page", http.StatusOK, "<HTML><BODY>HELLO example.com<script src=/banner.js></script></BODY></HTML>", ""},
+		{"/image", http.StatusOK, "internal.corp", ""},
+		{"/broken.json", http.StatusBadGateway, "", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			w := newMockResponseWriter()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL+tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.status, w.Code, w.buffer.String())
+			}
+			if tc.status != http.StatusOK {
+				if w.Header().Get("X-Proxy-Error") != string(CodeTransformFailed) {
+					t.Errorf("expected transform-failed, got %q", w.Header().Get("X-Proxy-Error"))
+				}
+				return
+			}
+
+			if w.buffer.String() != tc.body {
+				t.Errorf("expected body %q, got %q", tc.body, w.buffer.String())
+			}
+			if w.Header().Get("Content-Encoding") != "" {
+				t.Errorf("expected decoded body, got encoding %q", w.Header().Get("Content-Encoding"))
+			}
+			if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(tc.body)) {
+				t.Errorf("expected Content-Length %d, got %s", len(tc.body), cl)
+			}
+			if tc.etag != "" && w.Header().Get("ETag") != tc.etag {
+				t.Errorf("expected ETag %s, got %s", tc.etag, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestProxyTransformPanic(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer service.Close()
+
+	proxy := NewProxy(&http.Client{}, WithTransformer(TransformRule{Transformer: panicTransformer{}}))
+
+	w := newMockResponseWriter()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+	if w.Code != http.StatusBadGateway || w.Header().Get("X-Proxy-Error") != string(CodeTransformFailed) {
+		t.Errorf("expected a 502 transform-failed, got %d %q", w.Code, w.Header().Get("X-Proxy-Error"))
+	}
+}
+
+func TestTransformConfigValidation(t *testing.T) {
+	testCases := []struct {
+		name        string
+		cfg         TransformConfig
+		expectError string
+	}{
+		{"unknown type", TransformConfig{Type: "xslt"}, "type must be"},
+		{"bad pattern", TransformConfig{Type: "replace", Pattern: "("}, "valid regular expression"},
+		{"missing snippet", TransformConfig{Type: "html_inject"}, "needs a snippet"},
+		{"bad position", TransformConfig{Type: "html_inject", Snippet: "x", Position: "footer"}, "position"},
+		{"missing pointers", TransformConfig{Type: "json_remove"}, "at least one pointer"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.cfg.rule()
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("expected error containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+
+	if _, err := (TransformConfig{Type: "replace", Pattern: regexp.QuoteMeta("a.b")}).rule(); err != nil {
+		t.Errorf("expected valid replace transform, got %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+package proxy
+
+import "net/http"
+
+func forwardRequestBody(req, r *http.Request) {
+	req.ContentLength = r.ContentLength
+	if r.ContentLength == 0 {
+		req.Body = http.NoBody
+		req.Header.Del("Expect")
+	}
+
+	if len(r.Trailer) > 0 {
+		req.Trailer = r.Trailer
+		req.Header.Del("Trailer")
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingReader struct {
+	io.Reader
+	reads atomic.Int32
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	return r.Reader.Read(p)
+}
+
+func TestProxyExpectContinue(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		n, _ := io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-Received", strconv.FormatInt(n, 10))
+		w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}))
+	defer service.Close()
+
+	testCases := []struct {
+		name     string
+		path     string
+		hosts    HostPolicy
+		status   int
+		bodyRead bool
+	}{
+		{"upstream accepts", "/accept", HostPolicy{}, http.StatusOK, true},
+		{"upstream rejects", "/reject", HostPolicy{}, http.StatusRequestEntityTooLarge, false},
+		{"policy rejects", "/accept", HostPolicy{Deny: []string{"127.0.0.1"}}, http.StatusForbidden, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			policy.Hosts = tc.hosts
+			proxy := httptest.NewServer(NewProxy(&http.Client{}, WithPolicy(policy)))
+			defer proxy.Close()
+
+			body := &countingReader{Reader: strings.NewReader(strings.Repeat("x", 1000))}
+			req, _ := http.NewRequest(http.MethodPut, proxy.URL+"/proxy/"+service.URL+tc.path, body)
+			req.ContentLength = 1000
+			req.Header.Set("Expect", "100-continue")
+
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status code %d, got %d", tc.status, resp.StatusCode)
+			}
+			if read := body.reads.Load() > 0; read != tc.bodyRead {
+				t.Errorf("expected body read %v, got %v", tc.bodyRead, read)
+			}
+			if time.Since(start) > 3*time.Second {
+				t.Errorf("expected 100 Continue to be relayed without waiting for the client timeout, took %v", time.Since(start))
+			}
+			if tc.bodyRead && (resp.Header.Get("X-Received") != "1000" || resp.Header.Get("X-Content-Length") != "1000") {
+				t.Errorf("expected 1000 bytes with a declared length upstream, got %s of %s", resp.Header.Get("X-Received"), resp.Header.Get("X-Content-Length"))
+			}
+		})
+	}
+}
+
+func TestProxyStreamingUpload(t *testing.T) {
+	firstChunk := make(chan struct{})
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(r.Body, buf); err != nil || string(buf) != "first" {
+			http.Error(w, "bad first chunk", http.StatusBadRequest)
+			return
+		}
+		close(firstChunk)
+
+		rest, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Rest", string(rest))
+		w.Header().Set("X-Chunked", strconv.FormatBool(r.ContentLength == -1))
+		w.Header().Set("X-Checksum", r.Trailer.Get("X-Checksum"))
+	}))
+	defer service.Close()
+
+	proxy := httptest.NewServer(NewProxy(&http.Client{}))
+	defer proxy.Close()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/proxy/"+service.URL, pr)
+	req.Trailer = http.Header{"X-Checksum": nil}
+
+	go func() {
+		pw.Write([]byte("first"))
+		select {
+		case <-firstChunk:
+		case <-time.After(2 * time.Second):
+		}
+		req.Trailer.Set("X-Checksum", "abc123")
+		pw.Write([]byte("second"))
+		pw.Close()
+	}()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-firstChunk:
+	default:
+		t.Fatal("expected the first chunk to reach the upstream before the upload finished")
+	}
+	if resp.Header.Get("X-Rest") != "second" || resp.Header.Get("X-Chunked") != "true" {
+		t.Errorf("expected chunked upload to be streamed, got %v", resp.Header)
+	}
+	if resp.Header.Get("X-Checksum") != "abc123" {
+		t.Errorf("expected request trailer to be forwarded, got %q", resp.Header.Get("X-Checksum"))
+	}
+}
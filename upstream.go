@@ -0,0 +1,617 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const upstreamDirect = "DIRECT"
+
+// UpstreamRule sends requests for Hosts through Proxies, tried in order. A nil
+// proxy means a direct connection.
+type UpstreamRule struct {
+	Hosts   []string
+	Proxies []*url.URL
+}
+
+func (r UpstreamRule) matches(host string) bool {
+	for _, pattern := range r.Hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseUpstreamProxy(raw string) (*url.URL, error) {
+	if strings.EqualFold(raw, upstreamDirect) {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream proxy %q has no host", raw)
+	}
+
+	return u, nil
+}
+
+// UpstreamDialError reports that every route to Addr failed.
+type UpstreamDialError struct {
+	Addr string
+	Errs []error
+}
+
+func (e *UpstreamDialError) Error() string {
+	return fmt.Sprintf("all upstream routes to %s failed: %v", e.Addr, errors.Join(e.Errs...))
+}
+
+func (e *UpstreamDialError) Unwrap() []error {
+	return e.Errs
+}
+
+type upstreamDialer struct {
+	rules    func() []UpstreamRule
+	dialer   *net.Dialer
+	cooldown time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	failed   map[string]time.Time
+}
+
+func newUpstreamDialer(rules func() []UpstreamRule) *upstreamDialer {
+	return &upstreamDialer{
+		rules:    rules,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		cooldown: 30 * time.Second,
+		now:      time.Now,
+		failed:   make(map[string]time.Time),
+	}
+}
+
+func (d *upstreamDialer) routes(addr string) []*url.URL {
+	for _, rule := range d.rules() {
+		if rule.matches(addr) {
+			return rule.Proxies
+		}
+	}
+	return []*url.URL{nil}
+}
+
+// ordered returns the routes for addr, those cooling down after a failure last.
+func (d *upstreamDialer) ordered(addr string) []*url.URL {
+	routes := d.routes(addr)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	healthy := make([]*url.URL, 0, len(routes))
+	var cooling []*url.URL
+	for _, route := range routes {
+		if until, ok := d.failed[routeKey(route)]; ok && now.Before(until) {
+			cooling = append(cooling, route)
+			continue
+		}
+		healthy = append(healthy, route)
+	}
+	return append(healthy, cooling...)
+}
+
+func (d *upstreamDialer) record(route *url.URL, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err == nil {
+		delete(d.failed, routeKey(route))
+		return
+	}
+	d.failed[routeKey(route)] = d.now().Add(d.cooldown)
+}
+
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if route, ok := ctx.Value(routeContextKey{}).(*url.URL); ok {
+		return d.dialPinned(ctx, route, network, addr)
+	}
+
+	routes := d.ordered(addr)
+
+	var errs []error
+	for _, route := range routes {
+		conn, err := d.dialRoute(ctx, route, network, addr)
+		if err == nil {
+			d.record(route, nil)
+			return conn, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", routeName(route), err))
+		d.record(route, err)
+	}
+
+	if len(errs) == 1 && routes[0] == nil {
+		return nil, errors.Unwrap(errs[0])
+	}
+
+	return nil, &UpstreamDialError{Addr: addr, Errs: errs}
+}
+
+// dialPinned dials over the one route forwardTransport chose for the request.
+// When http.Transport connects to that route's proxy itself, to send the
+// request in absolute form, the proxy is dialled directly.
+func (d *upstreamDialer) dialPinned(ctx context.Context, route *url.URL, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if forwardsHTTP(route) && addr == proxyAddr(route) {
+		conn, err = d.dialer.DialContext(ctx, network, addr)
+	} else {
+		conn, err = d.dialRoute(ctx, route, network, addr)
+	}
+
+	if err != nil {
+		if ctx.Err() == nil {
+			d.record(route, err)
+		}
+		return nil, &routeDialError{route: route, err: err}
+	}
+
+	d.record(route, nil)
+	return conn, nil
+}
+
+type routeDialError struct {
+	route *url.URL
+	err   error
+}
+
+func (e *routeDialError) Error() string {
+	return routeName(e.route) + ": " + e.err.Error()
+}
+
+func (e *routeDialError) Unwrap() error {
+	return e.err
+}
+
+type routeContextKey struct{}
+
+// forwardTransport sends plain http requests to http and https upstream
+// proxies in absolute form, as http.Transport.Proxy does, instead of through
+// a CONNECT tunnel. It tries the routes in the same order as DialContext and
+// moves on when a route cannot be dialled, since nothing was sent over it.
+type forwardTransport struct {
+	base     http.RoundTripper
+	upstream *upstreamDialer
+}
+
+func (t *forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return t.base.RoundTrip(req)
+	}
+
+	addr := canonicalAddr(req.URL)
+	routes := t.upstream.ordered(addr)
+	if len(routes) == 1 && routes[0] == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	var body *heldBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &heldBody{ReadCloser: req.Body}
+		defer body.release()
+	}
+
+	var errs []error
+	for _, route := range routes {
+		attempt := req.WithContext(context.WithValue(req.Context(), routeContextKey{}, route))
+		if body != nil {
+			attempt.Body = body
+		}
+
+		body.hold()
+		resp, err := t.base.RoundTrip(attempt)
+		var routeErr *routeDialError
+		if err == nil || !errors.As(err, &routeErr) || req.Context().Err() != nil || body.used() {
+			return resp, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", routeName(route), routeErr.err))
+	}
+
+	return nil, &UpstreamDialError{Addr: addr, Errs: errs}
+}
+
+// heldBody keeps a request body open while forwardTransport might still send
+// it over another route. http.Transport closes the body when the dial fails,
+// before reading any of it.
+type heldBody struct {
+	io.ReadCloser
+	mu     sync.Mutex
+	held   bool
+	closed bool
+	read   bool
+}
+
+func (b *heldBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	b.read = true
+	b.mu.Unlock()
+	return b.ReadCloser.Read(p)
+}
+
+func (b *heldBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.held {
+		b.closed = true
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *heldBody) hold() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.held, b.closed = true, false
+	b.mu.Unlock()
+}
+
+func (b *heldBody) used() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.read
+}
+
+func (b *heldBody) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.held = false
+	if b.closed {
+		b.ReadCloser.Close()
+	}
+}
+
+// forwardProxy is the proxy for http.Transport.Proxy when forwardTransport
+// chose an http or https route for the request.
+func forwardProxy(req *http.Request) (*url.URL, bool) {
+	route, ok := req.Context().Value(routeContextKey{}).(*url.URL)
+	if ok && !forwardsHTTP(route) {
+		route = nil
+	}
+	return route, ok
+}
+
+func forwardsHTTP(route *url.URL) bool {
+	return route != nil && (route.Scheme == "http" || route.Scheme == "https")
+}
+
+func canonicalAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func routeKey(route *url.URL) string {
+	if route == nil {
+		return upstreamDirect
+	}
+	return route.String()
+}
+
+func routeName(route *url.URL) string {
+	if route == nil {
+		return upstreamDirect
+	}
+	return route.Redacted()
+}
+
+func (d *upstreamDialer) dialRoute(ctx context.Context, route *url.URL, network, addr string) (net.Conn, error) {
+	if route == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	conn, err := d.dialer.DialContext(ctx, "tcp", proxyAddr(route))
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	switch route.Scheme {
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: route.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+		fallthrough
+	case "http":
+		tunnel, err := httpConnect(conn, route.User, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	case "socks5":
+		addr, err = resolveLocally(ctx, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := socks5Connect(conn, route.User, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func resolveLocally(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+func proxyAddr(route *url.URL) string {
+	if route.Port() == "" {
+		return net.JoinHostPort(route.Hostname(), defaultProxyPort(route.Scheme))
+	}
+	return route.Host
+}
+
+func defaultProxyPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks5", "socks5h":
+		return "1080"
+	}
+	return "80"
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream proxy refused CONNECT: %s", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+const (
+	socksVersion5         = 0x05
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+	socksCmdConnect       = 0x01
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+	socksReplySucceeded   = 0x00
+)
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+
+	greeting := append([]byte{socksVersion5, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != socksVersion5 {
+		return fmt.Errorf("socks5: unexpected protocol version %d", choice[0])
+	}
+
+	switch choice[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errors.New("socks5: server requires authentication")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return err
+		}
+		if status[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	request, err := appendSocksAddr([]byte{socksVersion5, socksCmdConnect, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socksReplySucceeded {
+		return fmt.Errorf("socks5: connect failed with reply code %d", reply[1])
+	}
+
+	_, err = readSocksAddr(conn)
+	return err
+}
+
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socksAtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socksAtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host name %q too long", host)
+		}
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func readSocksAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("socks5: unknown address type %d", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
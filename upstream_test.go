@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func mustUpstreamRules(t *testing.T, cfg UpstreamConfig) []UpstreamRule {
+	t.Helper()
+
+	rules, err := cfg.rules()
+	if err != nil {
+		t.Fatalf("invalid upstream rules: %v", err)
+	}
+	return rules
+}
+
+func TestProxyUpstreamChaining(t *testing.T) {
+	testCases := []struct {
+		name      string
+		proxy     func() *mockUpstreamProxy
+		scheme    string
+		forwarded bool
+	}{
+		{
+			name:      "http absolute form",
+			proxy:     func() *mockUpstreamProxy { return mockConnectProxy("", "") },
+			scheme:    "http",
+			forwarded: true,
+		},
+		{
+			name:      "http absolute form with authentication",
+			proxy:     func() *mockUpstreamProxy { return mockConnectProxy("corp", "s3cret") },
+			scheme:    "http",
+			forwarded: true,
+		},
+		{
+			name:   "socks5",
+			proxy:  func() *mockUpstreamProxy { return mockSOCKS5Proxy("", "") },
+			scheme: "socks5",
+		},
+		{
+			name:   "socks5 with authentication",
+			proxy:  func() *mockUpstreamProxy { return mockSOCKS5Proxy("corp", "s3cret") },
+			scheme: "socks5h",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := mockTargetService()
+			defer service.Close()
+
+			upstream := tc.proxy()
+			defer upstream.Close()
+
+			policy := DefaultPolicy()
+			policy.Upstream = mustUpstreamRules(t, UpstreamConfig{Proxy: upstream.URL(tc.scheme)})
+			proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+			w := newMockResponseWriter()
+			r := httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil)
+			proxy.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.buffer.String())
+			}
+			if !strings.Contains(w.buffer.String(), mockExpectedResponseBody) {
+				t.Errorf("expected body %q, got %q", mockExpectedResponseBody, w.buffer.String())
+			}
+			if tc.forwarded && (upstream.forwarded.Load() != 1 || upstream.tunnels.Load() != 0) {
+				t.Errorf("expected one absolute-form request and no tunnel, got %d requests and %d tunnels", upstream.forwarded.Load(), upstream.tunnels.Load())
+			}
+			if !tc.forwarded && upstream.tunnels.Load() != 1 {
+				t.Errorf("expected one tunnel through the upstream proxy, got %d", upstream.tunnels.Load())
+			}
+		})
+	}
+}
+
+func TestProxyUpstreamRules(t *testing.T) {
+	t.Run("falls back to the next upstream proxy", func(t *testing.T) {
+		service := mockTargetService()
+		defer service.Close()
+
+		dead := mockConnectProxy("", "")
+		dead.Close()
+
+		alive := mockSOCKS5Proxy("", "")
+		defer alive.Close()
+
+		policy := DefaultPolicy()
+		policy.Upstream = mustUpstreamRules(t, UpstreamConfig{Rules: []UpstreamRuleConfig{
+			{Hosts: []string{"*"}, Proxies: []string{dead.URL("http"), alive.URL("socks5")}},
+		}})
+		proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.buffer.String())
+		}
+		if alive.tunnels.Load() != 1 {
+			t.Errorf("expected fallback proxy to carry the request, got %d tunnels", alive.tunnels.Load())
+		}
+	})
+
+	t.Run("selects the route by target host", func(t *testing.T) {
+		service := mockTargetService()
+		defer service.Close()
+
+		upstream := mockConnectProxy("", "")
+		defer upstream.Close()
+
+		policy := DefaultPolicy()
+		policy.Upstream = mustUpstreamRules(t, UpstreamConfig{Rules: []UpstreamRuleConfig{
+			{Hosts: []string{"127.0.0.1"}, Proxies: []string{"DIRECT"}},
+			{Hosts: []string{"*"}, Proxies: []string{upstream.URL("http")}},
+		}})
+		proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/"+service.URL, nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		if upstream.tunnels.Load() != 0 || upstream.forwarded.Load() != 0 {
+			t.Errorf("expected direct connection for matching rule, got %d tunnels and %d requests", upstream.tunnels.Load(), upstream.forwarded.Load())
+		}
+	})
+
+	t.Run("falls back to the next forwarding proxy", func(t *testing.T) {
+		service := mockTargetService()
+		defer service.Close()
+
+		dead := mockConnectProxy("", "")
+		dead.Close()
+
+		alive := mockConnectProxy("", "")
+		defer alive.Close()
+
+		policy := DefaultPolicy()
+		policy.Upstream = mustUpstreamRules(t, UpstreamConfig{Rules: []UpstreamRuleConfig{
+			{Hosts: []string{"*"}, Proxies: []string{dead.URL("http"), alive.URL("http")}},
+		}})
+		proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/proxy/"+service.URL, strings.NewReader("payload")))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.buffer.String())
+		}
+		if alive.forwarded.Load() != 1 {
+			t.Errorf("expected fallback proxy to receive the request, got %d", alive.forwarded.Load())
+		}
+	})
+
+	t.Run("reports failed forwarding proxies", func(t *testing.T) {
+		dead := mockConnectProxy("", "")
+		dead.Close()
+
+		policy := DefaultPolicy()
+		policy.Upstream = mustUpstreamRules(t, UpstreamConfig{Proxy: dead.URL("http")})
+		proxy := NewProxy(&http.Client{}, WithPolicy(policy))
+
+		w := newMockResponseWriter()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/proxy/http://example.com/", nil))
+
+		if got := ErrorCode(w.Header().Get("X-Proxy-Error")); got != CodeUpstreamProxyFailed {
+			t.Errorf("expected X-Proxy-Error %q, got %q (status %d)", CodeUpstreamProxyFailed, got, w.Code)
+		}
+	})
+
+	t.Run("reports every failed route", func(t *testing.T) {
+		first := mockConnectProxy("", "")
+		first.Close()
+		second := mockSOCKS5Proxy("corp", "right")
+		defer second.Close()
+
+		dialer := newUpstreamDialer(func() []UpstreamRule {
+			wrongCredentials, _ := url.Parse("socks5h://corp:wrong@" + second.listener.Addr().String())
+			rules := mustUpstreamRules(t, UpstreamConfig{Proxy: first.URL("http")})
+			rules[0].Proxies = append(rules[0].Proxies, wrongCredentials)
+			return rules
+		})
+
+		_, err := dialer.DialContext(t.Context(), "tcp", "example.com:80")
+		if err == nil {
+			t.Fatal("expected dial to fail")
+		}
+		if _, ok := err.(*UpstreamDialError); !ok || !strings.Contains(err.Error(), "authentication failed") {
+			t.Errorf("expected upstream dial error listing every route, got %v", err)
+		}
+		if strings.Contains(err.Error(), "wrong") {
+			t.Errorf("expected credentials to be redacted, got %v", err)
+		}
+	})
+}